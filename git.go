@@ -3,27 +3,381 @@
 package gogit
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ErrPullConflict is returned by Pull when SetAbortPullOnConflict is used
+// and the pull was aborted because of a conflict
+var ErrPullConflict = errors.New("pull aborted because of a conflict")
+
+// ErrNotFastForward is returned when a ref update would not be a fast-forward
+var ErrNotFastForward = errors.New("not a fast-forward")
+
+// ErrPushSignature is the cause of the error returned by Push when a signed push was requested
+// but couldn't be signed or the signature was rejected by the remote
+var ErrPushSignature = errors.New("signed push failed")
+
+// NotCleanError is returned by EnsureClean when the repo is not in a state
+// to safely operate on
+type NotCleanError struct {
+	// InProgress is the operation that is in progress, if any
+	InProgress string
+	// Dirty means there are uncommitted changes to tracked files
+	Dirty bool
+}
+
+func (e *NotCleanError) Error() string {
+	if e.InProgress != "" {
+		return "repo has a " + e.InProgress + " in progress"
+	}
+	return "repo has uncommitted changes"
+}
+
+// ErrPushRejected is the cause of the error returned by a push that was
+// rejected by the remote, e.g. because it was not a fast-forward
+var ErrPushRejected = errors.New("push rejected")
+
+// ErrNoUpstream is the cause of the error returned when the current branch
+// has no upstream branch configured
+var ErrNoUpstream = errors.New("no upstream configured")
+
+// MissingObjectsError is returned by VerifyConnectivity when objects that
+// are referenced in the repo are not present
+type MissingObjectsError struct {
+	Objects []string
+}
+
+func (e *MissingObjectsError) Error() string {
+	return fmt.Sprintf("%d missing objects: %s", len(e.Objects), strings.Join(e.Objects, ", "))
+}
+
+// ErrNoSuchStash is returned when a stash index is out of range
+var ErrNoSuchStash = errors.New("no such stash")
+
+// ErrReadOnly is returned by methods that change the repo when the repo
+// was created with SetReadOnly
+var ErrReadOnly = errors.New("repo is read-only")
+
+// ErrMergeConflict is returned when a merge resulted in conflicts. The
+// conflicts are left in the working tree to be resolved.
+var ErrMergeConflict = errors.New("merge conflict")
+
+// ErrWorkingTreeDirty is returned by CloneOrPull when tracked files have
+// uncommitted changes, unless SetOptAutoPull is used
+var ErrWorkingTreeDirty = errors.New("working tree has uncommitted changes")
+
+// ErrTagExists is returned by CreateTag when a tag with the same name
+// already exists
+var ErrTagExists = errors.New("tag already exists")
+
+// ErrMergeCommit is returned for merge commits by methods that need the
+// single patch of a commit
+var ErrMergeCommit = errors.New("commit is a merge")
+
+// ErrStashConflict is the cause of the error returned by StashPop when the
+// stash conflicts with the working tree. The stash is kept, and the
+// conflicts are left in the working tree to be resolved.
+var ErrStashConflict = errors.New("stash conflict")
+
+// ErrNoLocalChanges is returned by Stash when there is nothing to stash
+var ErrNoLocalChanges = errors.New("no local changes")
+
+// ErrSigningFailed is the cause of the error returned when a commit or tag
+// couldn't be signed, e.g. because the key is missing
+var ErrSigningFailed = errors.New("signing failed")
+
+// ErrNoSuchStateRef is returned by GetStateRef when the state ref doesn't
+// exist
+var ErrNoSuchStateRef = errors.New("no such state ref")
+
+// ErrNothingToCommit is returned by Commit and AddCommitPush when there
+// are no staged changes, unless SetOptAllowEmpty or SetSkipEmptyCommit is
+// used. Nothing was committed or pushed.
+var ErrNothingToCommit = errors.New("nothing to commit")
+
+// CherryPickConflictError is returned by Replay when a commit couldn't be
+// applied without conflicts. The cherry-pick is left in progress, so it
+// can be resumed with ReplayContinue once the conflicts are resolved.
+type CherryPickConflictError struct {
+	// Commit is the commit that conflicted
+	Commit string
+	// Files are the files with conflicts
+	Files []string
+}
+
+func (e *CherryPickConflictError) Error() string {
+	return "cherry-pick of " + e.Commit + " stopped with conflicts in " + strings.Join(e.Files, ", ")
+}
+
+// MergeConflictError is returned by Merge when the merge resulted in
+// conflicts. Its cause is ErrMergeConflict.
+type MergeConflictError struct {
+	// Files are the files with conflicts
+	Files []string
+}
+
+func (e *MergeConflictError) Error() string {
+	return "merge conflict in " + strings.Join(e.Files, ", ")
+}
+
+// Cause returns ErrMergeConflict, so errors.Cause can be used to check for
+// any merge conflict
+func (e *MergeConflictError) Cause() error {
+	return ErrMergeConflict
+}
+
+// Unwrap returns ErrMergeConflict, so errors.Is from the standard library
+// can be used to check for any merge conflict too
+func (e *MergeConflictError) Unwrap() error {
+	return ErrMergeConflict
+}
+
 type Repo struct {
 	logger  log.Logger
 	URL     string
 	Name    string
 	WorkDir string
 	RepoDir string
+	opts    GitOpts
+	// worktrees created by ParallelCheckout, guarded by worktreesMu
+	worktrees   []string
+	worktreesMu sync.Mutex
+	// branch is the branch passed to New
+	branch string
+	// SyncState is set by New when SetComputeSyncState is used
+	SyncState *SyncState
+	// cmdMu makes sure only one git command runs in the repo at a time
+	cmdMu sync.Mutex
+	// opMu is the lock of Lock and Unlock
+	opMu sync.Mutex
+}
+
+// Git is implemented by *Repo. Code that uses a repo can depend on Git
+// instead, so it can be tested with a fake. A fake can embed Git and only
+// implement the methods that are used, e.g.
+//
+//	type fakeGit struct {
+//		gogit.Git
+//		commit string
+//	}
+//
+//	func (f *fakeGit) CurrentCommit() (string, error) {
+//		return f.commit, nil
+//	}
+type Git interface {
+	Clone() error
+	CloneCtx(ctx context.Context) error
+	Pull(options ...SetOptFunc) error
+	PullCtx(ctx context.Context, options ...SetOptFunc) error
+	Fetch(options ...SetOptFunc) error
+	FetchTagsOnly() error
+	FetchAll(prune bool) error
+	CloneOrPull() error
+	CloneOrPullCtx(ctx context.Context) error
+	Commit(msg string, options ...SetOptFunc) (string, error)
+	CommitAll(msg string, options ...SetOptFunc) (string, error)
+	CommitPaths(msg string, paths ...string) (string, error)
+	VerifyCommit(rev string) (bool, error)
+	CommitTree(tree, msg string, parents ...string) (string, error)
+	CommitWithTree(tree, msg string, parents ...string) (string, error)
+	Push(options ...SetOptFunc) error
+	PushCtx(ctx context.Context, options ...SetOptFunc) error
+	PushRefspec(remote string, refspecs ...string) error
+	PushStatus() (*PushStatus, error)
+	RemoteRefs(remote string) (map[string]string, error)
+	Add(pattern string) error
+	AddCommitPush(msg string, options ...SetOptFunc) (skipped bool, err error)
+	Reset(rev string, mode ResetMode) error
+	Clean(options ...SetOptFunc) ([]string, error)
+	ResetToUpstream(hard bool) error
+	HasChanges() (bool, error)
+	WorkingState() (*WorkingState, error)
+	DirtyReason() (string, error)
+	PlanAddCommitPush() (*Plan, error)
+	Stash(message string) error
+	StashPop() error
+	StashList() ([]StashEntry, error)
+	StashApply(index int) error
+	StashDrop(index int) error
+	StashClear() error
+	Merge(branch string, options ...SetOptFunc) error
+	AbortMerge() error
+	SquashMerge(branch, msg string) error
+	Replay(from, to string) error
+	ReplayContinue() error
+	ReplayAbort() error
+	Checkout(b string, options ...SetOptFunc) error
+	AddHunks(path string, hunkIndexes []int) error
+	CheckoutIndex(paths ...string) error
+	FastForwardRef(branch, to string) error
+	BranchStatus() ([]BranchTrack, error)
+	Branch() (string, error)
+	Branches() ([]string, error)
+	CreateBranch(name, startPoint string) error
+	DeleteBranch(name string, force bool) error
+	CheckoutNew(name string) error
+	CurrentRef() (ref string, detached bool, err error)
+	MergedBranches(into string) ([]string, error)
+	DeleteMergedBranches(into string) ([]string, error)
+	SetStateRef(name, sha string) error
+	GetStateRef(name string) (string, error)
+	CurrentCommit() (string, error)
+	DiffStatus(c1, c2 string, options ...SetOptFunc) ([]*DiffStat, error)
+	FileChanged(path, c1, c2 string) (bool, error)
+	Log(opts LogOpts) ([]*Commit, error)
+	ChangelogCommits(from, to string, opts ChangelogOpts) ([]*Commit, error)
+	Remotes() (map[string]string, error)
+	AddRemote(name, url string) error
+	SetRemoteURL(name, url string) error
+	RemoveRemote(name string) error
+	RemoteURL(remote string) (string, error)
+	UpstreamURL() (string, error)
+	PatchID(commit string) (string, error)
+	SearchIntroduced(term string, isRegex bool, options ...SetOptFunc) ([]*Commit, error)
+	CommitFiles(commit string, options ...SetOptFunc) ([]*DiffStat, error)
+	DiffNumstat(c1, c2 string, options ...SetOptFunc) ([]*DiffNumstat, error)
+	BinaryChangedFiles(c1, c2 string) ([]string, error)
+	ReleaseDiff(tag string, options ...SetOptFunc) (*ReleaseDiffReport, error)
+	ShowDeletedFile(path string) (string, error)
+	FileVersions(path string, max int) ([]FileVersion, error)
+	TreeEntries(ref, dir string) ([]TreeEntry, error)
+	ShowForCommit(commit, path string) (string, error)
+	ShowFile(rev, path string) ([]byte, error)
+	CatFile(sha string) ([]byte, error)
+	CatFileType(sha string) (string, error)
+	FileExistsAt(rev, path string) (bool, error)
+	IsClean() bool
+	MatchesCommit(commit string) (bool, error)
+	ConflictedFiles() ([]string, error)
+	ResolveUsing(path string, side ResolveSide) error
+	ConflictHunks(path string) ([]ConflictHunk, error)
+	ExportRef(ref, destDir string) error
+	ArchiveSubtree(ref, subdir string, w io.Writer, format string, options ...SetOptFunc) error
+	AuthorStats(since, until string) (map[string]AuthorStat, error)
+	EnsureClean() error
+	CommitGraph(max int, options ...SetOptFunc) ([]GraphNode, error)
+	Tags() ([]string, error)
+	TagExists(name string) (bool, error)
+	CreateTag(name, message string, options ...SetOptFunc) error
+	PushTags(tags ...string) error
+	TagsOnBranch(branch string) ([]TagInfo, error)
+	BlameAtRef(path, ref string, options ...SetOptFunc) ([]BlameLine, error)
+	Blame(path string, options ...SetOptFunc) ([]BlameLine, error)
+	ShowTag(tag string) (*TagDetail, error)
+	ShallowBoundary() ([]string, error)
+	LargeObjects(threshold int64) ([]LargeObject, error)
+	VerifyConnectivity() error
+	WorktreeAdd(dir, ref string) (*Repo, error)
+	WorktreeRemove(dir string, options ...SetOptFunc) error
+	WorktreePrune() error
+	ParallelCheckout(refs []string, baseDir string) ([]*Repo, error)
+	CleanupWorktrees() error
+	HasLFS() (bool, error)
+	CommitAuthor(commit string) (string, error)
+	CommitAuthorName(commit string) (string, error)
+	CommitAuthorIdentity(commit string) (*Identity, error)
+	CommitCommitter(commit string) (name, email string, date time.Time, err error)
+	Status() ([]*StatusEntry, error)
+	Lock()
+	Unlock()
 }
 
+var _ Git = (*Repo)(nil)
+
 type GitOpts struct {
-	Rebase   bool
-	CloneDir string
+	Rebase              bool
+	CloneDir            string
+	UseDashC            bool
+	AbortPullOnConflict bool
+	NoGPGSign           bool
+	CloneArgs           []string
+	NoCheckout          bool
+	SignPush            bool
+	Offline             bool
+	ShallowExclude      []string
+	CommitDate          string
+	ForceCheckout       bool
+	BlameMoves          bool
+	BlameCopies         bool
+	LogRecordSeparator  string
+	LogFieldSeparator   string
+	FindRenames         int
+	FindCopies          bool
+	FindCopiesHarder    bool
+	ForceWorktreeRemove bool
+	InitialBranch       string
+	PushOptions         []string
+	ReadOnly            bool
+	Jobs                int
+	JobsSet             bool
+	HTTPPostBuffer      int
+	LowSpeedLimit       int
+	LowSpeedTime        int
+	AuthUsername        string
+	AuthPassword        string
+	SkipEmptyCommit     bool
+	SSHKey              string
+	SSHKnownHosts       string
+	StrictHostKeyCheck  bool
+	StrictHostKeySet    bool
+	ArchivePrefix       string
+	AutoPull            bool
+	LightweightTag      bool
+	FetchPrune          bool
+	FetchRemote         string
+	FetchRefspecs       []string
+	ArgTransform        func(args []string) []string
+	MergeNoFF           bool
+	MergeFFOnly         bool
+	MergeMessage        string
+	CleanDirs           bool
+	CleanIgnored        bool
+	Force               bool
+	ComputeSyncState    bool
+	StashPull           bool
+	MergeDrivers        map[string]string
+	Sign                bool
+	SigningKey          string
+	SigningFormat       string
+	AuthorName          string
+	AuthorEmail         string
+	AuthorDate          string
+	CommitterName       string
+	CommitterEmail      string
+	MessageCleanup      string
+	AllowEmpty          bool
+	PushRemote          string
+	PushRefspecs        []string
+	PushBranch          string
+	PushSetUpstream     bool
+	ForceWithLease      bool
+	CheckoutRef         string
+	BlameRev            string
+	BlameStart          int
+	BlameEnd            int
+	CommitTemplate      string
+	TagTemplate         string
+	GitBinary           string
+	Env                 []string
+	Depth               int
+	SingleBranch        bool
 }
 
 type ModType int
@@ -32,258 +386,4233 @@ const (
 	StatNew ModType = iota
 	StatModified
 	StatDeleted
+	StatRenamed
+	StatCopied
 )
 
 type DiffStat struct {
 	Stat ModType
 	Filename string
+	// OldFilename is only set for renamed and copied files
+	OldFilename string
 }
 
-type SetOptFunc func(o *GitOpts)
+type DiffNumstat struct {
+	Added       int
+	Deleted     int
+	Binary      bool
+	Filename    string
+	OldFilename string
+}
 
-func SetOptRebase() SetOptFunc {
+type ReleaseDiffFile struct {
+	DiffStat
+	Added   int
+	Deleted int
+	Binary  bool
+}
+
+type ReleaseDiffReport struct {
+	Tag     string
+	Files   []*ReleaseDiffFile
+	Added   int
+	Deleted int
+}
+
+// SetAbortPullOnConflict makes Pull abort a conflicting rebase or merge,
+// leaving the repo as it was before, and return ErrPullConflict
+func SetAbortPullOnConflict() SetOptFunc {
 	return func(o *GitOpts) {
-		o.Rebase = true
+		o.AbortPullOnConflict = true
 	}
 }
 
-func SetCloneDir(s string) SetOptFunc {
+// SetNoGPGSign makes commits pass --no-gpg-sign, overriding a configured
+// commit.gpgsign
+func SetNoGPGSign() SetOptFunc {
 	return func(o *GitOpts) {
-		o.CloneDir = s
+		o.NoGPGSign = true
 	}
 }
 
+// SetNoCheckout clones without checking out a working tree, for when only
+// the history is needed or a checkout is done later on. New doesn't check
+// out the requested branch in that case.
+func SetNoCheckout() SetOptFunc {
+	return func(o *GitOpts) {
+		o.NoCheckout = true
+	}
+}
 
-func New(url, branch, workDir string, logger log.Logger, options ...SetOptFunc) (*Repo, error) {
-	opts := getOpts(options)
+// SetSignPush makes Push sign the push with --signed
+func SetSignPush() SetOptFunc {
+	return func(o *GitOpts) {
+		o.SignPush = true
+	}
+}
 
-	// get the name from the url
-	parts := strings.Split(url, "/")
-	repoName := parts[len(parts)-1:][0]
-	if strings.HasSuffix(repoName, ".git") {
-		repoName = repoName[:len(repoName)-4]
+// SetOffline makes New skip the clone or pull when the repo is already
+// present locally, so no network operation is done
+func SetOffline() SetOptFunc {
+	return func(o *GitOpts) {
+		o.Offline = true
 	}
+}
 
-	repo := &Repo{
-		logger:  log.With(logger, "module", "git", "class", "Repo", "repo", url),
-		URL:     url,
-		WorkDir: workDir,
-		Name:    repoName,
+// SetShallowExclude makes the clone leave out the history reachable from
+// ref. It can be given multiple times to exclude several refs.
+func SetShallowExclude(ref string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.ShallowExclude = append(o.ShallowExclude, ref)
 	}
-	if opts.CloneDir != "" {
-		repo.RepoDir = path.Join(workDir, opts.CloneDir)
-	} else {
-		repo.RepoDir = path.Join(workDir, repo.Name)
+}
+
+// SetCommitDate sets both the author and committer date of a commit to
+// raw, which is passed to git as is. Relative dates like "2 hours ago" are
+// resolved by git to a timestamp.
+func SetCommitDate(raw string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CommitDate = raw
 	}
+}
 
-	err := repo.CloneOrPull()
-	if err != nil {
-		return nil, err
+// SetForceCheckout makes Checkout pass -f, so local changes that would
+// block switching branches are thrown away. Those changes are lost!
+func SetForceCheckout() SetOptFunc {
+	return func(o *GitOpts) {
+		o.ForceCheckout = true
 	}
+}
 
-	currentBranch, err := repo.Branch()
-	if err != nil {
-		return nil, err
+// SetBlameMoves makes blame detect lines moved within a file (-M)
+func SetBlameMoves() SetOptFunc {
+	return func(o *GitOpts) {
+		o.BlameMoves = true
 	}
-	if currentBranch != branch {
-		err := repo.Checkout(branch)
-		if err != nil {
-			return nil, err
-		}
+}
+
+// SetBlameCopies makes blame detect lines moved or copied from other
+// files (-C)
+func SetBlameCopies() SetOptFunc {
+	return func(o *GitOpts) {
+		o.BlameCopies = true
 	}
-	return repo, nil
 }
 
-func (r *Repo) Clone() error {
-	_ = level.Debug(r.logger).Log("msg", "cloning repo")
-	_, err := os.Stat(r.WorkDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return errors.New("parent dir does not exist")
-		}
-		return errors.Wrap(err, "failed to stat parent dir")
+// SetBlameRev makes Blame blame the file as it was at rev
+func SetBlameRev(rev string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.BlameRev = rev
 	}
-	cmd := exec.Command("git", "clone", r.URL, r.RepoDir)
-	cmd.Dir = r.WorkDir
-	out, err := cmd.CombinedOutput()
-	if err != nil || !cmd.ProcessState.Success() {
-		return errors.Wrap(err, "failed to clone repo: "+string(out))
+}
+
+// SetBlameRange limits blame to the lines start to end, counting from 1.
+// With end 0 blame runs to the end of the file.
+func SetBlameRange(start, end int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.BlameStart = start
+		o.BlameEnd = end
 	}
-	_, err = r.doGit("remote", "set-url", "origin", r.URL)
-	return err
+}
 
+// SetLogSeparators sets the separators between commits and between the
+// fields of a commit used when parsing structured log output. They default
+// to the ASCII record (0x1e) and unit (0x1f) separators; pick others if
+// those can occur in commit messages.
+func SetLogSeparators(record, field string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.LogRecordSeparator = record
+		o.LogFieldSeparator = field
+	}
 }
 
-func (r *Repo) Pull(options ...SetOptFunc) (error) {
-	opts := getOpts(options)
-	_ = level.Debug(r.logger).Log("msg", "pulling repo", "rebase", opts.Rebase)
-	cmd := []string{"pull"}
-	if opts.Rebase {
-		cmd = append(cmd, "--rebase")
+// SetFindRenames sets the similarity percentage above which diffs treat a
+// deleted and an added file as a rename, instead of git's default of 50
+func SetFindRenames(percent int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.FindRenames = percent
 	}
-	_, err := r.doGit(cmd...)
-	return err
 }
 
-func (r *Repo) CloneOrPull() (error) {
-	if _, err := os.Stat(path.Join(r.RepoDir, ".git")); os.IsNotExist(err) {
-		return r.Clone()
-	} else {
-		if !r.IsClean() {
-			return r.Pull(SetOptRebase())
-		}
-		return nil
+// SetFindCopies makes diffs detect copies of files that were modified in
+// the same change. With harder, all files are considered as copy source,
+// which is slow on large repos.
+func SetFindCopies(harder bool) SetOptFunc {
+	return func(o *GitOpts) {
+		o.FindCopies = true
+		o.FindCopiesHarder = harder
 	}
 }
 
-func (r *Repo) Commit(msg string) (error) {
-	_, err := r.doGit("commit", "-m", msg)
-	return err
+// SetForceWorktreeRemove makes WorktreeRemove remove worktrees that have
+// uncommitted changes, which are lost
+func SetForceWorktreeRemove() SetOptFunc {
+	return func(o *GitOpts) {
+		o.ForceWorktreeRemove = true
+	}
 }
 
-func (r *Repo) Push() (error) {
-	_ = level.Debug(r.logger).Log("msg", "pushing repo")
-	_, err := r.doGit("push")
-	return err
+// SetInitialBranch sets the name of the initial branch for Init
+func SetInitialBranch(name string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.InitialBranch = name
+	}
 }
 
-func (r *Repo) Add(pattern string) (error) {
-	_, err := r.doGit("add", pattern)
-	return err
+// SetPushOption passes a push option (-o) to the remote, e.g. ci.skip for
+// GitLab. It can be given multiple times.
+func SetPushOption(opt string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.PushOptions = append(o.PushOptions, opt)
+	}
 }
 
-func (r *Repo) AddCommitPush(msg string) (error) {
-	err := r.Add(".")
-	if err != nil {
-		return err
+// SetReadOnly makes all methods that change the repo return ErrReadOnly
+// without running git. New still clones or pulls the repo before the
+// guard applies, and fetching is allowed as it only updates remote refs.
+func SetReadOnly() SetOptFunc {
+	return func(o *GitOpts) {
+		o.ReadOnly = true
 	}
-	err = r.Commit(msg)
-	if err != nil {
-		return err
+}
+
+// SetJobs sets the number of parallel jobs (--jobs) used when cloning,
+// pulling and fetching, e.g. for submodules and multiple remotes. n must
+// be at least 1.
+func SetJobs(n int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.Jobs = n
+		o.JobsSet = true
 	}
-	return r.Push()
 }
 
-func (r *Repo) Checkout(b string) error {
-	_ = level.Debug(r.logger).Log("msg", "checkout", "branch", b)
-	_, err := r.doGit("checkout", b)
-	return err
+// SetHTTPPostBuffer sets git's http.postBuffer, which helps against "RPC
+// failed" errors when pushing large changes over HTTP(S)
+func SetHTTPPostBuffer(bytes int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.HTTPPostBuffer = bytes
+	}
 }
 
-func (r *Repo) Branch() (string, error) {
-	//bashCmd := "git branch | grep '*' | sed 's/* //g'"
-	out, err := r.doGit("branch")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get branche info")
+// SetLowSpeedLimit makes HTTP(S) transfers abort when they are slower than
+// bytes per second for longer than seconds
+func SetLowSpeedLimit(bytes, seconds int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.LowSpeedLimit = bytes
+		o.LowSpeedTime = seconds
 	}
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "*") {
-			return line[2:], nil
-		}
+}
+
+// SetAuthToken authenticates HTTPS remotes with a token, e.g. a personal
+// access token. The token is passed to git through the environment, so it
+// doesn't show up in command lines or error messages.
+func SetAuthToken(token string) SetOptFunc {
+	return SetBasicAuth("x-access-token", token)
+}
+
+// SetBasicAuth authenticates HTTPS remotes with a username and password,
+// the same way as SetAuthToken
+func SetBasicAuth(user, pass string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.AuthUsername = user
+		o.AuthPassword = pass
 	}
-	return "", errors.New("unexpected output from git command")
-	/*
+}
 
-	return strings.TrimSpace(string(out)), nil
-*/
+// SetSkipEmptyCommit makes Commit and AddCommitPush skip the commit, and
+// the push, when the index doesn't differ from HEAD. That isn't an error:
+// Commit returns an empty hash and AddCommitPush reports skipped.
+func SetSkipEmptyCommit() SetOptFunc {
+	return func(o *GitOpts) {
+		o.SkipEmptyCommit = true
+	}
 }
 
-func (r *Repo) CurrentCommit() (string, error) {
-	// git rev-parse HEAD
-	out, err := r.doGit("rev-parse", "HEAD")
-	if err != nil { return "", err }
-	return strings.TrimSuffix(out, "\n"), nil
+// SetSSHKey makes git use the private key at path for SSH remotes instead
+// of the default key or the SSH agent. The key only applies to the Repo it
+// is passed to, other repos keep using their own key or the default one.
+func SetSSHKey(path string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.SSHKey = path
+	}
 }
 
-var statMap = map[string]ModType{
-	"A": StatNew,
-	"M": StatModified,
-	"D": StatDeleted,
+// SetSSHKnownHosts makes git's SSH connections check host keys against the
+// known hosts file at path instead of the user's one
+func SetSSHKnownHosts(path string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.SSHKnownHosts = path
+	}
 }
-func (r *Repo) DiffStatus(c1, c2 string) ([]*DiffStat, error) {
-	out, err := r.doGit("diff", "--name-status", c1, c2)
-	if err != nil { return nil, err }
-	var ok bool
-	var diffs []*DiffStat
-	for _, line := range strings.Split(out, "\n") {
-		fields := strings.Fields(line)
-		if len(fields) == 2 {
-			ds := DiffStat{
-				Filename: fields[1],
-			}
-			if ds.Stat, ok = statMap[fields[0]]; !ok {
-				// no idea what this is, just ignore it
-				continue
-			}
-			diffs = append(diffs, &ds)
-		}
+
+// SetStrictHostKeyChecking turns SSH's StrictHostKeyChecking on or off.
+// When it's off, unknown host keys are accepted and added to the known
+// hosts file.
+func SetStrictHostKeyChecking(strict bool) SetOptFunc {
+	return func(o *GitOpts) {
+		o.StrictHostKeyCheck = strict
+		o.StrictHostKeySet = true
 	}
-	return diffs, err
 }
 
-// ShowDeletedFile fetches the last version of a file, from just
-// before it got deleted from the current repo and branch
-func (r *Repo) ShowDeletedFile(path string) (string, error) {
-	out, err := r.doGit("log", "--full-history", "-2", "--", path)
-	if err != nil {
-		return "", err
+// SetArchivePrefix prepends prefix to every path in an archive. Add a
+// trailing slash to put the files in a directory.
+func SetArchivePrefix(prefix string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.ArchivePrefix = prefix
 	}
-	// Git output is of the format:
-	// commit $hash\n
-	// Author ...\n
-	// ...
-	commitID := 0
-	commit := ""
-	fmt.Println("History: ", out)
-	for _, line := range strings.Split(out, "\n") {
-		if strings.HasPrefix(line, "commit") {
-			commitID++
-			fmt.Println("commitID: ", commitID)
-			if commitID == 2 {
-				commit = line[strings.Index(line, " ")+1:]
-				fmt.Println("Second commit: ", commit)
-				break
-			}
-		}
+}
+
+// SetGitBinary sets the path of the git binary to run instead of the git
+// found in PATH
+func SetGitBinary(path string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.GitBinary = path
 	}
-	return r.ShowForCommit(commit, path)
 }
 
-func (r *Repo) ShowForCommit(commit, path string) (string, error) {
-	return r.doGit("show", fmt.Sprintf("%s:%s", commit, path))
+// SetEnv sets an environment variable for every git command, on top of the
+// environment of the current process, e.g. GIT_TERMINAL_PROMPT=0 to fail
+// instead of prompting for a password
+func SetEnv(key, value string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.Env = append(o.Env, key+"="+value)
+	}
 }
 
-func (r *Repo) IsClean() (bool) {
-	_, err := r.doGit("fetch")
-	if err != nil {
-		return false
+// SetDepth makes Clone create a shallow clone with history truncated to n
+// commits. CloneOrPull keeps such a clone shallow by fetching with the
+// same depth and resetting instead of pulling, which fails with
+// ErrNotFastForward when there are local commits.
+func SetDepth(n int) SetOptFunc {
+	return func(o *GitOpts) {
+		o.Depth = n
 	}
-	out, err := r.doGit("status")
-	if err != nil {
-		return false
+}
+
+// SetSingleBranch makes Clone only fetch the branch passed to New instead
+// of all branches
+func SetSingleBranch(single bool) SetOptFunc {
+	return func(o *GitOpts) {
+		o.SingleBranch = single
 	}
-	if strings.Contains(string(out), "up-to-date") && strings.Contains(string(out), "working directory clean") {
-		return true
+}
+
+// SetLightweightTag makes CreateTag create a lightweight tag, which is
+// just a ref to the commit, instead of an annotated tag
+func SetLightweightTag() SetOptFunc {
+	return func(o *GitOpts) {
+		o.LightweightTag = true
 	}
-	return false
 }
 
-func (r *Repo) CommitAuthor(commit string) (string, error) {
-	out, err := r.doGit("log", "--format='%ae'", commit+"^!")
-	if err != nil { return "", errors.Wrap(err, "error retrieving author for commit " + commit) }
-	return out, nil
+// SetFetchPrune makes Fetch remove remote-tracking branches that no
+// longer exist on the remote
+func SetFetchPrune() SetOptFunc {
+	return func(o *GitOpts) {
+		o.FetchPrune = true
+	}
 }
 
-func (r *Repo) doGit(args ...string) (string, error) {
-	_, err := os.Stat(r.WorkDir)
-	cmd := exec.Command("git", args...)
-	cmd.Dir = r.RepoDir
-	out, err := cmd.CombinedOutput()
-	if err != nil || !cmd.ProcessState.Success() {
-		return "", errors.Wrap(err, "failed to run command 'git "+strings.Join(args, " ")+"' on repo "+r.Name+": "+string(out))
+// SetFetchRemote sets the remote Fetch fetches from, instead of origin
+func SetFetchRemote(remote string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.FetchRemote = remote
 	}
-	return string(out), nil
+}
+
+// SetFetchRefspecs makes Fetch fetch refspecs instead of the refspecs
+// configured for the remote
+func SetFetchRefspecs(refspecs ...string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.FetchRefspecs = append(o.FetchRefspecs, refspecs...)
+	}
+}
+
+// SetArgTransform sets a function that gets the arguments of every git
+// command right before it's run, and returns the arguments to run it with
+// instead. It's an escape hatch for flags that are not supported otherwise.
+func SetArgTransform(transform func(args []string) []string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.ArgTransform = transform
+	}
+}
+
+// SetMergeNoFF makes Merge always create a merge commit, even when the
+// merge could be a fast-forward
+func SetMergeNoFF() SetOptFunc {
+	return func(o *GitOpts) {
+		o.MergeNoFF = true
+	}
+}
+
+// SetMergeFFOnly makes Merge fail unless the merge is a fast-forward
+func SetMergeFFOnly() SetOptFunc {
+	return func(o *GitOpts) {
+		o.MergeFFOnly = true
+	}
+}
+
+// SetMergeMessage sets the message of the merge commit created by Merge
+func SetMergeMessage(msg string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.MergeMessage = msg
+	}
+}
+
+// SetCleanDirs makes Clean remove untracked directories too
+func SetCleanDirs() SetOptFunc {
+	return func(o *GitOpts) {
+		o.CleanDirs = true
+	}
+}
+
+// SetCleanIgnored makes Clean remove ignored files too
+func SetCleanIgnored() SetOptFunc {
+	return func(o *GitOpts) {
+		o.CleanIgnored = true
+	}
+}
+
+// SetForce makes Clean actually remove files instead of only reporting
+// what would be removed
+func SetForce() SetOptFunc {
+	return func(o *GitOpts) {
+		o.Force = true
+	}
+}
+
+// SetComputeSyncState makes New set the SyncState of the repo once it has
+// been cloned or pulled
+func SetComputeSyncState() SetOptFunc {
+	return func(o *GitOpts) {
+		o.ComputeSyncState = true
+	}
+}
+
+// SetMergeDriver configures the custom merge driver name to run driver,
+// for merges, pulls and replays only. driver must contain the %O, %A and
+// %B placeholders, see gitattributes(5). Files use the driver when they
+// have the merge=name attribute.
+func SetMergeDriver(name, driver string) SetOptFunc {
+	return func(o *GitOpts) {
+		drivers := make(map[string]string, len(o.MergeDrivers)+1)
+		for n, d := range o.MergeDrivers {
+			drivers[n] = d
+		}
+		drivers[name] = driver
+		o.MergeDrivers = drivers
+	}
+}
+
+// SetOptSign makes Commit and CreateTag sign the commit or tag, with the
+// key set with SetSigningKey or git's default key
+func SetOptSign() SetOptFunc {
+	return func(o *GitOpts) {
+		o.Sign = true
+	}
+}
+
+// SetSigningKey sets the key to sign with when SetOptSign is used. It's a
+// GPG key id, or the path of a key for SSH signing.
+func SetSigningKey(keyid string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.SigningKey = keyid
+	}
+}
+
+// SetSigningFormat sets the format of signatures, "openpgp", "x509" or
+// "ssh", instead of git's configured gpg.format
+func SetSigningFormat(format string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.SigningFormat = format
+	}
+}
+
+// SetAuthor sets the author of commits, instead of the user from git's
+// config. The config itself is left alone.
+func SetAuthor(name, email string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.AuthorName = name
+		o.AuthorEmail = email
+	}
+}
+
+// SetCommitter sets the committer of commits, like SetAuthor does for the
+// author. It's also the tagger of annotated tags.
+func SetCommitter(name, email string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CommitterName = name
+		o.CommitterEmail = email
+	}
+}
+
+// SetAuthorDate sets the author date of a commit, overriding the date set
+// with SetCommitDate. raw is any date git understands.
+func SetAuthorDate(raw string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.AuthorDate = raw
+	}
+}
+
+// SetMessageCleanup sets how Commit and CreateTag clean up messages, one
+// of "strip", "whitespace", "verbatim" or "scissors". git's default strips
+// lines starting with #, "verbatim" keeps the message as is.
+func SetMessageCleanup(mode string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.MessageCleanup = mode
+	}
+}
+
+// SetOptAllowEmpty makes Commit create a commit even when there are no
+// staged changes
+func SetOptAllowEmpty() SetOptFunc {
+	return func(o *GitOpts) {
+		o.AllowEmpty = true
+	}
+}
+
+// SetPushRemote makes Push push to remote instead of the remote of the
+// current branch's upstream
+func SetPushRemote(remote string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.PushRemote = remote
+	}
+}
+
+// SetPushRefspec makes Push push refspecs, e.g. "HEAD:refs/heads/main",
+// instead of the current branch. Without SetPushRemote they are pushed to
+// origin.
+func SetPushRefspec(refspecs ...string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.PushRefspecs = append(o.PushRefspecs, refspecs...)
+	}
+}
+
+// SetPushBranch makes Push push the current branch to branch on the
+// remote, instead of to the branch with the same name
+func SetPushBranch(branch string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.PushBranch = branch
+	}
+}
+
+// SetUpstream makes Push set the pushed branch as the upstream of the
+// current branch, which is needed for the first push of a new branch
+func SetUpstream() SetOptFunc {
+	return func(o *GitOpts) {
+		o.PushSetUpstream = true
+	}
+}
+
+// SetForceWithLease makes Push overwrite the remote branch even when it's
+// not a fast-forward, but only when the remote branch is still where it
+// was last fetched, so concurrent pushes are not lost
+func SetForceWithLease() SetOptFunc {
+	return func(o *GitOpts) {
+		o.ForceWithLease = true
+	}
+}
+
+// SetCommitTemplate sets git's commit.template to the file at path and
+// makes Commit append its content to the message, as git itself only uses
+// the template when it starts an editor
+func SetCommitTemplate(path string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CommitTemplate = path
+	}
+}
+
+// SetTagTemplate makes CreateTag append the content of the file at path to
+// the message of annotated tags
+func SetTagTemplate(path string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.TagTemplate = path
+	}
+}
+
+// ApplyTemplate returns msg followed by template, separated by a blank
+// line. Commit and CreateTag remove the comment lines of templates, unless
+// SetMessageCleanup is used to keep them.
+func ApplyTemplate(template, msg string) string {
+	template = strings.TrimSpace(template)
+	if template == "" {
+		return msg
+	}
+	return strings.TrimRight(msg, "\n") + "\n\n" + template + "\n"
+}
+
+// SetCloneArgs adds extra arguments to the git clone command. They are
+// appended verbatim after the arguments set by the other options, so they
+// can be used for flags that are not supported otherwise.
+func SetCloneArgs(args ...string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CloneArgs = append(o.CloneArgs, args...)
+	}
+}
+
+type FileVersion struct {
+	Commit  string
+	Date    time.Time
+	Content string
+}
+
+// ConflictHunk is a region of a conflicted file, as marked by git
+type ConflictHunk struct {
+	// StartLine and EndLine are the 1-based lines of the
+	// <<<<<<< and >>>>>>> markers
+	StartLine int
+	EndLine   int
+	OursLabel string
+	Ours      string
+	// BaseLabel and Base are only set for diff3 style conflicts
+	BaseLabel   string
+	Base        string
+	TheirsLabel string
+	Theirs      string
+}
+
+// BranchTrack describes how a local branch relates to its upstream
+type BranchTrack struct {
+	Branch   string
+	Upstream string
+	Ahead    int
+	Behind   int
+	// Gone means the upstream branch has been deleted
+	Gone bool
+}
+
+type AuthorStat struct {
+	Commits int
+	Added   int
+	Deleted int
+}
+
+// GraphNode is a commit in the commit graph, with the refs pointing at it
+type GraphNode struct {
+	Commit  string
+	Parents []string
+	Refs    []string
+}
+
+type TagInfo struct {
+	Name   string
+	Commit string
+	// Date is the tagger date for annotated tags and the commit date
+	// for lightweight tags
+	Date time.Time
+}
+
+// BlameLine is a line of a file with the commit that last changed it
+type BlameLine struct {
+	Commit      string
+	AuthorName  string
+	AuthorEmail string
+	// Time is the author time of Commit
+	Time time.Time
+	// Filename is the name of the file in Commit, which differs from the
+	// blamed file if the line was moved or copied
+	Filename string
+	// OrigLine is the line number in Commit, LineNo in the blamed file
+	OrigLine int
+	LineNo   int
+	Content  string
+}
+
+// TagDetail describes a tag. The tagger fields and message are empty for
+// lightweight tags.
+type TagDetail struct {
+	Name        string
+	Annotated   bool
+	Commit      string
+	Tagger      string
+	TaggerEmail string
+	Date        time.Time
+	Message     string
+}
+
+// Plan describes what AddCommitPush would do
+type Plan struct {
+	// Files are the files that would be staged
+	Files []string
+	// Commit means there are changes that would be committed
+	Commit bool
+	// Push means there are local commits that would be pushed
+	Push bool
+	// Upstream is the branch that would be pushed to, empty if the
+	// current branch has no upstream, in which case the push would fail
+	Upstream string
+	// Ahead is the number of local commits not on the upstream yet
+	Ahead int
+}
+
+// WorkingState holds the changes in the index and working tree
+type WorkingState struct {
+	// Staged are the changes in the index compared to HEAD
+	Staged []*DiffStat
+	// Unstaged are the changes in the working tree compared to the index
+	Unstaged []*DiffStat
+	// Untracked are the files not known to git, which are all StatNew
+	Untracked []*DiffStat
+}
+
+// Commit is a commit as returned by the log based methods
+type Commit struct {
+	Hash        string
+	AuthorName  string
+	AuthorEmail string
+	Date        time.Time
+	Subject     string
+	// Trailers are the trailers at the end of the message, like
+	// "Signed-off-by", by key in the order they appear
+	Trailers map[string][]string
+}
+
+// ResolveSide is the side of a conflict to resolve it with
+type ResolveSide int
+
+const (
+	// Ours is the current branch, or the upstream being rebased onto
+	// during a rebase
+	Ours ResolveSide = iota
+	// Theirs is the branch being merged, or the commit being replayed
+	// during a rebase
+	Theirs
+)
+
+// Identity is the author or committer of a commit
+type Identity struct {
+	Name  string
+	Email string
+	Date  time.Time
+}
+
+// TreeEntry is an entry in a directory of a tree. Type is "blob" for
+// files, "tree" for directories and "commit" for submodules.
+type TreeEntry struct {
+	Mode string
+	Type string
+	SHA  string
+	Name string
+}
+
+// LogOpts selects the commits returned by Log. Zero values mean no limit.
+type LogOpts struct {
+	MaxCount int
+	// Since is any date git understands, e.g. "2019-01-01" or "2 weeks ago"
+	Since string
+	// Path limits the log to commits touching this file or directory
+	Path string
+	// Range is a revision range like "v1.0..v1.1", defaults to HEAD
+	Range string
+}
+
+// ChangelogOpts filters the commits returned by ChangelogCommits
+type ChangelogOpts struct {
+	// NoMerges leaves out merge commits
+	NoMerges bool
+	// FirstParent only follows the first parent of merges, so a merged
+	// branch shows up as its merge commit instead of its commits
+	FirstParent bool
+	// Path limits the commits to those touching this file or directory
+	Path string
+}
+
+// StatusEntry is a file as reported by git status. Index and WorkTree are
+// git's short status codes for the staged and unstaged changes, e.g. 'M'
+// for modified or ' ' for unchanged. Both are '?' for untracked files.
+type StatusEntry struct {
+	Index    byte
+	WorkTree byte
+	Path     string
+	// OrigPath is the path a renamed or copied file was staged from
+	OrigPath string
+}
+
+// ResetMode is how Reset treats the index and the working tree
+type ResetMode int
+
+const (
+	// ResetSoft only moves the branch, changes stay staged
+	ResetSoft ResetMode = iota
+	// ResetMixed also resets the index, changes are kept as unstaged
+	ResetMixed
+	// ResetHard also resets the working tree, discarding all changes
+	ResetHard
+)
+
+// SyncState is the state of the current branch compared to its upstream.
+// Ahead and Behind are 0 when there's no upstream.
+type SyncState struct {
+	Ahead  int
+	Behind int
+	// Clean means the working tree has no changes
+	Clean bool
+}
+
+// StashEntry is a stash as returned by StashList
+type StashEntry struct {
+	// Index is the index to pass to StashApply and StashDrop, 0 is the
+	// most recent stash
+	Index   int
+	Commit  string
+	Message string
+}
+
+// LargeObject is a blob in the history that is larger than the threshold
+// passed to LargeObjects
+type LargeObject struct {
+	SHA  string
+	Path string
+	Size int64
+	// Commits are the commits that added or removed the blob
+	Commits []string
+}
+
+type PushAction int
+
+const (
+	// PushNone means local and upstream are identical
+	PushNone PushAction = iota
+	// PushNormal means the branch is ahead and can be pushed as is
+	PushNormal
+	// PushPull means the branch is behind and needs to be pulled first
+	PushPull
+	// PushForce means the branch has diverged, so it either needs to
+	// be force-pushed or rebased onto its upstream
+	PushForce
+)
+
+type PushStatus struct {
+	Branch   string
+	Upstream string
+	Ahead    int
+	Behind   int
+	Action   PushAction
+}
+
+type SetOptFunc func(o *GitOpts)
+
+func SetOptRebase() SetOptFunc {
+	return func(o *GitOpts) {
+		o.Rebase = true
+	}
+}
+
+// SetOptAutoPull makes CloneOrPull pull even when tracked files have
+// uncommitted changes, instead of returning ErrWorkingTreeDirty
+func SetOptAutoPull() SetOptFunc {
+	return func(o *GitOpts) {
+		o.AutoPull = true
+	}
+}
+
+// SetOptStashPull makes CloneOrPull stash uncommitted changes to tracked
+// files, pull and pop the stash again, instead of returning
+// ErrWorkingTreeDirty
+func SetOptStashPull() SetOptFunc {
+	return func(o *GitOpts) {
+		o.StashPull = true
+	}
+}
+
+// SetCheckoutRef makes New check out ref, which can be a branch, a tag or
+// a commit, instead of the branch passed to it. A new clone is checked out
+// once, directly at ref.
+func SetCheckoutRef(ref string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CheckoutRef = ref
+	}
+}
+
+func SetCloneDir(s string) SetOptFunc {
+	return func(o *GitOpts) {
+		o.CloneDir = s
+	}
+}
+
+// SetUseDashC makes the repo run git as 'git -C <dir> ...' from the
+// current working directory instead of changing the command's working dir.
+func SetUseDashC() SetOptFunc {
+	return func(o *GitOpts) {
+		o.UseDashC = true
+	}
+}
+
+
+func New(url, branch, workDir string, logger log.Logger, options ...SetOptFunc) (*Repo, error) {
+	return NewCtx(context.Background(), url, branch, workDir, logger, options...)
+}
+
+// NewCtx is New with a context that bounds the clone or pull of the repo
+func NewCtx(ctx context.Context, url, branch, workDir string, logger log.Logger, options ...SetOptFunc) (*Repo, error) {
+	opts := getOpts(options)
+
+	// get the name from the url
+	parts := strings.Split(url, "/")
+	repoName := parts[len(parts)-1:][0]
+	if strings.HasSuffix(repoName, ".git") {
+		repoName = repoName[:len(repoName)-4]
+	}
+
+	repo := &Repo{
+		logger:  log.With(logger, "module", "git", "class", "Repo", "repo", url),
+		URL:     url,
+		WorkDir: workDir,
+		Name:    repoName,
+		opts:    *opts,
+		branch:  branch,
+	}
+	if opts.CloneDir != "" {
+		repo.RepoDir = path.Join(workDir, opts.CloneDir)
+	} else {
+		repo.RepoDir = path.Join(workDir, repo.Name)
+	}
+
+	// the read-only guard only applies once the repo has been set up
+	repo.opts.ReadOnly = false
+	defer func() { repo.opts.ReadOnly = opts.ReadOnly }()
+
+	if !opts.Offline || !repo.exists() {
+		err := repo.CloneOrPullCtx(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.NoCheckout {
+		return repo, repo.computeSyncState()
+	}
+	if opts.CheckoutRef != "" {
+		if err := repo.checkoutRef(opts.CheckoutRef); err != nil {
+			return nil, err
+		}
+		return repo, repo.computeSyncState()
+	}
+	if !repo.isBranch(branch) {
+		// a tag or commit, which is checked out as a detached HEAD
+		if err := repo.checkoutDetached(branch); err != nil {
+			return nil, err
+		}
+		return repo, repo.computeSyncState()
+	}
+
+	currentBranch, err := repo.Branch()
+	if err != nil {
+		return nil, err
+	}
+	if currentBranch != branch {
+		err := repo.Checkout(branch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repo, repo.computeSyncState()
+}
+
+// computeSyncState sets SyncState when SetComputeSyncState is used. It
+// compares with the upstream as fetched by CloneOrPull.
+func (r *Repo) computeSyncState() error {
+	if !r.opts.ComputeSyncState {
+		return nil
+	}
+	state := &SyncState{}
+	if !r.opts.NoCheckout {
+		clean, err := r.workTreeClean()
+		if err != nil {
+			return err
+		}
+		state.Clean = clean
+	}
+	if _, err := r.upstream(); err == nil {
+		state.Ahead, state.Behind, err = r.aheadBehind("HEAD", "@{u}")
+		if err != nil {
+			return err
+		}
+	}
+	r.SyncState = state
+	return nil
+}
+
+// Init creates a new, empty repo called name in workDir. The repo has no
+// remote, so URL is left empty.
+func Init(name, workDir string, logger log.Logger, options ...SetOptFunc) (*Repo, error) {
+	opts := getOpts(options)
+	repo := &Repo{
+		logger:  log.With(logger, "module", "git", "class", "Repo", "repo", name),
+		WorkDir: workDir,
+		Name:    name,
+		RepoDir: path.Join(workDir, name),
+		opts:    *opts,
+	}
+	if opts.CloneDir != "" {
+		repo.RepoDir = path.Join(workDir, opts.CloneDir)
+	}
+	_ = level.Debug(repo.logger).Log("msg", "initializing repo", "branch", opts.InitialBranch)
+	if _, err := os.Stat(workDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("parent dir does not exist")
+		}
+		return nil, errors.Wrap(err, "failed to stat parent dir")
+	}
+	// git runs in workDir, so the target has to be relative to it
+	target, err := filepath.Rel(workDir, repo.RepoDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to determine repo dir")
+	}
+	args := []string{"init"}
+	if opts.InitialBranch != "" {
+		args = append(args, "--initial-branch="+opts.InitialBranch)
+	}
+	cmd := repo.gitCmd(context.Background(), workDir, append(args, target)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil && opts.InitialBranch != "" {
+		// git before 2.28 doesn't know --initial-branch, so point HEAD
+		// at the branch after a plain init instead
+		cmd = repo.gitCmd(context.Background(), workDir, "init", target)
+		if out, err = cmd.CombinedOutput(); err == nil {
+			_, err = repo.doGit("symbolic-ref", "HEAD", "refs/heads/"+opts.InitialBranch)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init repo: "+string(out))
+	}
+	return repo, nil
+}
+
+func (r *Repo) Clone() error {
+	return r.CloneCtx(context.Background())
+}
+
+// CloneCtx is Clone with a context, cancelling it kills git
+func (r *Repo) CloneCtx(ctx context.Context) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "cloning repo")
+	_, err := os.Stat(r.WorkDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("parent dir does not exist")
+		}
+		return errors.Wrap(err, "failed to stat parent dir")
+	}
+	args := []string{"clone"}
+	jobs, err := r.opts.jobsArgs()
+	if err != nil {
+		return err
+	}
+	args = append(args, jobs...)
+	if r.opts.NoCheckout || r.opts.CheckoutRef != "" {
+		// with a CheckoutRef New does the checkout
+		args = append(args, "--no-checkout")
+	}
+	if r.opts.Depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(r.opts.Depth))
+	}
+	if r.opts.SingleBranch {
+		args = append(args, "--single-branch")
+		if r.branch != "" {
+			args = append(args, "--branch", r.branch)
+		}
+	}
+	for _, ref := range r.opts.ShallowExclude {
+		args = append(args, "--shallow-exclude="+ref)
+	}
+	args = append(args, r.opts.CloneArgs...)
+	// git runs in WorkDir, so the target has to be relative to it
+	target, err := filepath.Rel(r.WorkDir, r.RepoDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to determine clone dir")
+	}
+	args = append(args, r.URL, target)
+	cmd := r.gitCmd(ctx, r.WorkDir, args...)
+	r.cmdMu.Lock()
+	out, err := combinedOutput(ctx, cmd)
+	r.cmdMu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "clone of repo aborted")
+	}
+	if err != nil || !cmd.ProcessState.Success() {
+		return errors.Wrap(err, "failed to clone repo: "+r.redact(string(out)))
+	}
+	_, err = r.doGit("remote", "set-url", "origin", r.URL)
+	return err
+
+}
+
+func (r *Repo) Pull(options ...SetOptFunc) (error) {
+	return r.PullCtx(context.Background(), options...)
+}
+
+// PullCtx is Pull with a context, cancelling it kills git
+func (r *Repo) PullCtx(ctx context.Context, options ...SetOptFunc) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	opts := r.callOpts(options)
+	_ = level.Debug(r.logger).Log("msg", "pulling repo", "rebase", opts.Rebase)
+	cmd, err := opts.mergeDriverArgs()
+	if err != nil {
+		return err
+	}
+	cmd = append(cmd, "pull")
+	if opts.Rebase {
+		cmd = append(cmd, "--rebase")
+	}
+	jobs, err := opts.jobsArgs()
+	if err != nil {
+		return err
+	}
+	_, err = r.doGitEnvCtx(ctx, opts.identityEnv(), append(cmd, jobs...)...)
+	if err != nil && opts.AbortPullOnConflict {
+		return r.abortPull(err)
+	}
+	return err
+}
+
+// abortPull aborts a rebase or merge left behind by a failed pull
+func (r *Repo) abortPull(pullErr error) error {
+	abort := r.inProgress()
+	if abort != "rebase" && abort != "merge" {
+		// nothing to abort, so the pull failed for another reason
+		return pullErr
+	}
+	_ = level.Debug(r.logger).Log("msg", "aborting conflicting pull", "operation", abort, "err", pullErr)
+	if _, err := r.doGit(abort, "--abort"); err != nil {
+		return errors.Wrap(err, "failed to abort "+abort+" after conflicting pull")
+	}
+	return ErrPullConflict
+}
+
+// Fetch fetches from origin, or the remote set with SetFetchRemote
+func (r *Repo) Fetch(options ...SetOptFunc) error {
+	opts := r.callOpts(options)
+	remote := "origin"
+	if opts.FetchRemote != "" {
+		remote = opts.FetchRemote
+	}
+	cmd := []string{"fetch"}
+	if opts.FetchPrune {
+		cmd = append(cmd, "--prune")
+	}
+	jobs, err := opts.jobsArgs()
+	if err != nil {
+		return err
+	}
+	cmd = append(cmd, jobs...)
+	cmd = append(cmd, remote)
+	cmd = append(cmd, opts.FetchRefspecs...)
+	_ = level.Debug(r.logger).Log("msg", "fetching", "remote", remote, "prune", opts.FetchPrune)
+	_, err = r.doGit(cmd...)
+	return err
+}
+
+// FetchTagsOnly fetches the tags of origin without updating any branches
+func (r *Repo) FetchTagsOnly() error {
+	_ = level.Debug(r.logger).Log("msg", "fetching tags")
+	_, err := r.doGit("fetch", "--no-tags", "origin", "+refs/tags/*:refs/tags/*")
+	return err
+}
+
+// FetchAll fetches all remotes, optionally pruning deleted remote branches.
+// Git continues with the other remotes when one fails and reports the
+// failure afterwards.
+func (r *Repo) FetchAll(prune bool) error {
+	_ = level.Debug(r.logger).Log("msg", "fetching all remotes", "prune", prune)
+	cmd := []string{"fetch", "--all"}
+	if prune {
+		cmd = append(cmd, "--prune")
+	}
+	jobs, err := r.opts.jobsArgs()
+	if err != nil {
+		return err
+	}
+	_, err = r.doGit(append(cmd, jobs...)...)
+	return err
+}
+
+func (r *Repo) CloneOrPull() (error) {
+	return r.CloneOrPullCtx(context.Background())
+}
+
+// CloneOrPullCtx is CloneOrPull with a context, cancelling it kills git
+func (r *Repo) CloneOrPullCtx(ctx context.Context) error {
+	if !r.exists() {
+		return r.CloneCtx(ctx)
+	} else {
+		if r.opts.NoCheckout {
+			// there's no working tree to pull into
+			_, err := r.doGitCtx(ctx, "fetch")
+			return err
+		}
+		if r.isDetached() {
+			// there's no branch to pull into, e.g. when pinned to a tag
+			_, err := r.doGitCtx(ctx, "fetch", "--tags")
+			return err
+		}
+		if !r.opts.AutoPull {
+			dirty, err := r.hasLocalChanges()
+			if err != nil {
+				return err
+			}
+			if dirty && r.opts.StashPull {
+				return r.stashPull(ctx)
+			}
+			if dirty {
+				return ErrWorkingTreeDirty
+			}
+		}
+		if _, err := r.doGitCtx(ctx, "fetch"); err != nil {
+			return err
+		}
+		if !r.IsClean() {
+			if r.gitPathExists("shallow") {
+				return r.updateShallow(ctx)
+			}
+			return r.PullCtx(ctx, SetOptRebase())
+		}
+		return nil
+	}
+}
+
+// stashPull stashes the local changes, pulls and pops the stash again
+func (r *Repo) stashPull(ctx context.Context) error {
+	if err := r.Stash("gogit: stash before pull"); err != nil {
+		return err
+	}
+	if err := r.PullCtx(ctx, SetOptRebase()); err != nil {
+		// put the changes back, the pull didn't change anything
+		if popErr := r.StashPop(); popErr != nil {
+			_ = level.Warn(r.logger).Log("msg", "failed to pop stash after failed pull", "err", popErr)
+		}
+		return err
+	}
+	return r.StashPop()
+}
+
+// updateShallow fetches the upstream of the current branch with the
+// configured depth and resets to it, as a shallow clone can't be rebased.
+// Local commits and changes would be lost, so ErrNotFastForward or
+// ErrWorkingTreeDirty is returned instead when there are any.
+func (r *Repo) updateShallow(ctx context.Context) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	ahead, _, err := r.aheadBehind("HEAD", "@{u}")
+	if err != nil {
+		return err
+	}
+	if ahead > 0 {
+		return errors.Wrap(ErrNotFastForward, "shallow clone has "+strconv.Itoa(ahead)+" local commits")
+	}
+	dirty, err := r.hasLocalChanges()
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return ErrWorkingTreeDirty
+	}
+	args := []string{"fetch"}
+	if r.opts.Depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(r.opts.Depth))
+	}
+	_ = level.Debug(r.logger).Log("msg", "updating shallow clone", "depth", r.opts.Depth)
+	if _, err := r.doGitCtx(ctx, args...); err != nil {
+		return err
+	}
+	_, err = r.doGitCtx(ctx, "reset", "--hard", "@{u}")
+	return err
+}
+
+// Commit commits the staged changes with msg and returns the hash of the
+// new commit, or an empty hash when SetSkipEmptyCommit skipped it
+func (r *Repo) Commit(msg string, options ...SetOptFunc) (string, error) {
+	return r.commit(r.callOpts(options), msg)
+}
+
+// CommitAll stages all changes, including untracked files, and commits
+// them like Commit
+func (r *Repo) CommitAll(msg string, options ...SetOptFunc) (string, error) {
+	if err := r.Add("."); err != nil {
+		return "", err
+	}
+	return r.Commit(msg, options...)
+}
+
+// CommitPaths stages and commits only the changes to paths, leaving other
+// changes, staged or not, uncommitted
+func (r *Repo) CommitPaths(msg string, paths ...string) (string, error) {
+	if len(paths) == 0 {
+		return "", errors.New("no paths to commit")
+	}
+	if err := r.writable(); err != nil {
+		return "", err
+	}
+	if _, err := r.doGit(append([]string{"add", "--"}, paths...)...); err != nil {
+		return "", err
+	}
+	return r.commit(&r.opts, msg, paths...)
+}
+
+// commit commits with opts. With paths only those paths are committed.
+func (r *Repo) commit(opts *GitOpts, msg string, paths ...string) (string, error) {
+	if err := r.writable(); err != nil {
+		return "", err
+	}
+	if opts.SkipEmptyCommit && !opts.AllowEmpty {
+		staged, err := r.hasStagedChanges()
+		if err != nil {
+			return "", err
+		}
+		if !staged {
+			_ = level.Debug(r.logger).Log("msg", "skipping commit, no changes")
+			return "", nil
+		}
+	}
+	cleanup, err := opts.cleanupArgs()
+	if err != nil {
+		return "", err
+	}
+	if opts.CommitTemplate != "" {
+		template, err := ioutil.ReadFile(opts.CommitTemplate)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read commit template")
+		}
+		msg = ApplyTemplate(string(template), msg)
+	}
+	cmd := append(opts.signingFormatArgs(), "commit", "-m", msg)
+	cmd = append(cmd, cleanup...)
+	if opts.CommitTemplate != "" {
+		cmd = append([]string{"-c", "commit.template=" + opts.CommitTemplate}, cmd...)
+		if opts.MessageCleanup == "" {
+			// git keeps comments in messages passed with -m by default
+			cmd = append(cmd, "--cleanup=strip")
+		}
+	}
+	if opts.AllowEmpty {
+		cmd = append(cmd, "--allow-empty")
+	}
+	if opts.NoGPGSign {
+		cmd = append(cmd, "--no-gpg-sign")
+	}
+	if opts.Sign {
+		if opts.SigningKey != "" {
+			cmd = append(cmd, "--gpg-sign="+opts.SigningKey)
+		} else {
+			cmd = append(cmd, "-S")
+		}
+	}
+	if len(paths) > 0 {
+		cmd = append(append(cmd, "--"), paths...)
+	}
+	env := append(opts.identityEnv(), opts.dateEnv()...)
+	_, err = r.doGitEnv(env, cmd...)
+	if err != nil && strings.Contains(err.Error(), "invalid date format") {
+		// the date env vars only take absolute dates, so let git resolve
+		// relative ones to a timestamp first
+		resolved := *opts
+		for _, date := range []*string{&resolved.CommitDate, &resolved.AuthorDate} {
+			if *date == "" {
+				continue
+			}
+			var dateErr error
+			if *date, dateErr = r.approxDate(*date); dateErr != nil {
+				return "", dateErr
+			}
+		}
+		env = append(opts.identityEnv(), resolved.dateEnv()...)
+		_, err = r.doGitEnv(env, cmd...)
+	}
+	if err != nil && exitCode(err) == 1 {
+		if staged, stagedErr := r.hasStagedChanges(); stagedErr == nil && !staged {
+			return "", ErrNothingToCommit
+		}
+	}
+	if err := signingErr(opts, err); err != nil {
+		return "", err
+	}
+	return r.CurrentCommit()
+}
+
+// signingErr wraps err in ErrSigningFailed when signing was requested and
+// err is about the signature
+func signingErr(opts *GitOpts, err error) error {
+	if err == nil || !opts.Sign {
+		return err
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "failed to sign") || strings.Contains(msg, "unable to sign") ||
+		strings.Contains(msg, "failed to write commit object") {
+		return errors.Wrap(ErrSigningFailed, msg)
+	}
+	return err
+}
+
+// VerifyCommit checks whether rev has a good signature
+func (r *Repo) VerifyCommit(rev string) (bool, error) {
+	commit, err := r.revParse(rev + "^{commit}")
+	if err != nil {
+		return false, err
+	}
+	_, err = r.doGit("verify-commit", commit)
+	if err == nil {
+		return true, nil
+	}
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// identityEnv returns the environment variables that set the author and
+// committer of commits, as set with SetAuthor and SetCommitter. Every
+// command that creates commits or tags runs with them.
+func (o *GitOpts) identityEnv() []string {
+	var env []string
+	if o.AuthorName != "" || o.AuthorEmail != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+o.AuthorName, "GIT_AUTHOR_EMAIL="+o.AuthorEmail)
+	}
+	if o.CommitterName != "" || o.CommitterEmail != "" {
+		env = append(env, "GIT_COMMITTER_NAME="+o.CommitterName, "GIT_COMMITTER_EMAIL="+o.CommitterEmail)
+	}
+	return env
+}
+
+// dateEnv returns the environment variables that set the dates of commits,
+// as set with SetCommitDate and SetAuthorDate
+func (o *GitOpts) dateEnv() []string {
+	authorDate := o.CommitDate
+	if o.AuthorDate != "" {
+		authorDate = o.AuthorDate
+	}
+	var env []string
+	if authorDate != "" {
+		env = append(env, "GIT_AUTHOR_DATE="+authorDate)
+	}
+	if o.CommitDate != "" {
+		env = append(env, "GIT_COMMITTER_DATE="+o.CommitDate)
+	}
+	return env
+}
+
+// approxDate lets git parse a possibly relative date and returns it as
+// a unix timestamp in git's internal date format
+func (r *Repo) approxDate(date string) (string, error) {
+	out, err := r.doGit("rev-parse", "--since="+date)
+	if err != nil {
+		return "", err
+	}
+	// rev-parse outputs the date as --max-age=<timestamp>
+	ts := strings.TrimPrefix(strings.TrimSpace(out), "--max-age=")
+	if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+		return "", errors.New("invalid date: " + date)
+	}
+	return "@" + ts + " +0000", nil
+}
+
+// CommitTree creates a commit object for tree with the given parents and
+// returns its SHA. No branch is updated.
+func (r *Repo) CommitTree(tree, msg string, parents ...string) (string, error) {
+	if err := r.writable(); err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", tree, "-m", msg}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	out, err := r.doGitEnv(r.opts.identityEnv(), args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// CommitWithTree commits tree on the current branch without using the
+// index or working tree, which are left as they are. Without parents the
+// current HEAD is used as parent. Returns the SHA of the new commit.
+func (r *Repo) CommitWithTree(tree, msg string, parents ...string) (string, error) {
+	head, err := r.CurrentCommit()
+	if err != nil {
+		return "", err
+	}
+	if len(parents) == 0 {
+		parents = []string{head}
+	}
+	commit, err := r.CommitTree(tree, msg, parents...)
+	if err != nil {
+		return "", err
+	}
+	_ = level.Debug(r.logger).Log("msg", "committing tree", "tree", tree, "commit", commit)
+	if _, err := r.doGit("update-ref", "-m", "commit (tree): "+msg, "HEAD", commit, head); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+func (r *Repo) Push(options ...SetOptFunc) (error) {
+	return r.PushCtx(context.Background(), options...)
+}
+
+// PushCtx is Push with a context, cancelling it kills git
+func (r *Repo) PushCtx(ctx context.Context, options ...SetOptFunc) error {
+	opts := r.callOpts(options)
+	refspecs := opts.PushRefspecs
+	if len(refspecs) == 0 && opts.PushBranch != "" {
+		refspecs = []string{"HEAD:refs/heads/" + opts.PushBranch}
+	}
+	if len(refspecs) == 0 && opts.PushSetUpstream {
+		// there's no upstream yet to tell git what to push
+		branch, detached, err := r.CurrentRef()
+		if err != nil {
+			return err
+		}
+		if detached {
+			return errors.New("can't set upstream, HEAD is detached")
+		}
+		refspecs = []string{branch}
+	}
+	var args []string
+	if opts.PushSetUpstream {
+		args = append(args, "--set-upstream")
+	}
+	if opts.PushRemote != "" || len(refspecs) > 0 {
+		remote := opts.PushRemote
+		if remote == "" {
+			remote = "origin"
+		}
+		args = append(append(args, remote), refspecs...)
+	}
+	_ = level.Debug(r.logger).Log("msg", "pushing repo", "signed", opts.SignPush, "args", strings.Join(args, " "))
+	return r.push(ctx, opts, args...)
+}
+
+// PushRefspec pushes the given refspecs, e.g. "HEAD:refs/for/master" or
+// "local:remote", to remote
+func (r *Repo) PushRefspec(remote string, refspecs ...string) error {
+	opts := r.callOpts(nil)
+	_ = level.Debug(r.logger).Log("msg", "pushing refspecs", "remote", remote, "refspecs", strings.Join(refspecs, " "))
+	return r.push(context.Background(), opts, append([]string{remote}, refspecs...)...)
+}
+
+func (r *Repo) push(ctx context.Context, opts *GitOpts, args ...string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	cmd := []string{"push"}
+	if opts.SignPush {
+		cmd = append(cmd, "--signed")
+	}
+	if opts.ForceWithLease {
+		cmd = append(cmd, "--force-with-lease")
+	}
+	for _, opt := range opts.PushOptions {
+		cmd = append(cmd, "-o", opt)
+	}
+	_, err := r.doGitCtx(ctx, append(cmd, args...)...)
+	if err == nil {
+		return nil
+	}
+	if opts.SignPush && isSignatureError(err) {
+		return errors.Wrap(ErrPushSignature, err.Error())
+	}
+	if strings.Contains(err.Error(), "[rejected]") || strings.Contains(err.Error(), "[remote rejected]") {
+		return errors.Wrap(ErrPushRejected, err.Error())
+	}
+	if strings.Contains(err.Error(), "has no upstream branch") {
+		return errors.Wrap(ErrNoUpstream, err.Error())
+	}
+	return err
+}
+
+// isSignatureError checks whether a failed push failed because of signing
+func isSignatureError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "gpg failed to sign") ||
+		strings.Contains(msg, "does not support --signed push") ||
+		strings.Contains(msg, "push certificate")
+}
+
+// PushStatus determines, without pushing, how the current branch relates
+// to its upstream and thus which action is needed to push it.
+func (r *Repo) PushStatus() (*PushStatus, error) {
+	if _, err := r.doGit("fetch"); err != nil {
+		return nil, err
+	}
+	branch, err := r.Branch()
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := r.upstream()
+	if err != nil {
+		return nil, err
+	}
+	ps := &PushStatus{
+		Branch:   branch,
+		Upstream: upstream,
+	}
+	ps.Ahead, ps.Behind, err = r.aheadBehind("HEAD", "@{u}")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ps.Ahead > 0 && ps.Behind > 0:
+		ps.Action = PushForce
+	case ps.Behind > 0:
+		ps.Action = PushPull
+	case ps.Ahead > 0:
+		ps.Action = PushNormal
+	default:
+		ps.Action = PushNone
+	}
+	return ps, nil
+}
+
+// RemoteRefs lists the branches and tags of a remote with the SHAs they
+// point to, without fetching. Annotated tags resolve to the tagged commit.
+func (r *Repo) RemoteRefs(remote string) (map[string]string, error) {
+	out, err := r.doGit("ls-remote", "--heads", "--tags", remote)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	peeled := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(fields[1], "refs/heads/")
+		name = strings.TrimPrefix(name, "refs/tags/")
+		if strings.HasSuffix(name, "^{}") {
+			peeled[strings.TrimSuffix(name, "^{}")] = fields[0]
+			continue
+		}
+		refs[name] = fields[0]
+	}
+	for name, sha := range peeled {
+		refs[name] = sha
+	}
+	return refs, nil
+}
+
+func (r *Repo) Add(pattern string) (error) {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_, err := r.doGit("add", pattern)
+	return err
+}
+
+// AddCommitPush stages all changes, commits them with msg and pushes.
+// skipped is set when SetSkipEmptyCommit skipped the commit and the push.
+func (r *Repo) AddCommitPush(msg string, options ...SetOptFunc) (skipped bool, err error) {
+	sha, err := r.CommitAll(msg, options...)
+	if err != nil {
+		return false, err
+	}
+	if sha == "" {
+		return true, nil
+	}
+	return false, r.Push()
+}
+
+// Reset resets the current branch to rev, see ResetMode for what happens
+// to the index and the working tree
+func (r *Repo) Reset(rev string, mode ResetMode) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	var flag string
+	switch mode {
+	case ResetSoft:
+		flag = "--soft"
+	case ResetMixed:
+		flag = "--mixed"
+	case ResetHard:
+		flag = "--hard"
+	default:
+		return errors.Errorf("unknown reset mode %d", mode)
+	}
+	_ = level.Debug(r.logger).Log("msg", "resetting", "rev", rev, "mode", flag)
+	_, err := r.doGit("reset", flag, rev, "--")
+	return err
+}
+
+// Clean returns the untracked files that would be removed by git clean.
+// They are only removed with SetForce.
+func (r *Repo) Clean(options ...SetOptFunc) ([]string, error) {
+	opts := r.callOpts(options)
+	cmd := []string{"clean"}
+	if opts.Force {
+		if err := r.writable(); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, "-f")
+	} else {
+		cmd = append(cmd, "-n")
+	}
+	if opts.CleanDirs {
+		cmd = append(cmd, "-d")
+	}
+	if opts.CleanIgnored {
+		cmd = append(cmd, "-x")
+	}
+	_ = level.Debug(r.logger).Log("msg", "cleaning", "force", opts.Force)
+	out, err := r.doGit(cmd...)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		for _, prefix := range []string{"Would remove ", "Removing "} {
+			if strings.HasPrefix(line, prefix) {
+				paths = append(paths, strings.TrimPrefix(line, prefix))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// ResetToUpstream fetches and resets the current branch to its upstream,
+// discarding local commits. With hard, local changes in the working tree
+// are discarded too, otherwise they are kept as unstaged changes.
+func (r *Repo) ResetToUpstream(hard bool) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	upstream, err := r.upstream()
+	if err != nil {
+		return err
+	}
+	if _, err := r.doGit("fetch"); err != nil {
+		return err
+	}
+	mode := "--mixed"
+	if hard {
+		mode = "--hard"
+	}
+	_ = level.Debug(r.logger).Log("msg", "resetting to upstream", "upstream", upstream, "mode", mode)
+	_, err = r.doGit("reset", mode, "@{u}")
+	return err
+}
+
+// HasChanges checks whether there are any changes in the working tree or
+// the index, including untracked files
+func (r *Repo) HasChanges() (bool, error) {
+	clean, err := r.workTreeClean()
+	if err != nil {
+		return false, err
+	}
+	return !clean, nil
+}
+
+// WorkingState returns the staged, unstaged and untracked changes in a
+// single snapshot
+func (r *Repo) WorkingState() (*WorkingState, error) {
+	entries, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	ws := &WorkingState{}
+	for _, entry := range entries {
+		if entry.Index == '?' {
+			ws.Untracked = append(ws.Untracked, &DiffStat{Stat: StatNew, Filename: entry.Path})
+			continue
+		}
+		if stat, ok := statMap[string(entry.Index)]; ok {
+			ds := &DiffStat{Stat: stat, Filename: entry.Path}
+			if stat == StatRenamed || stat == StatCopied {
+				ds.OldFilename = entry.OrigPath
+			}
+			ws.Staged = append(ws.Staged, ds)
+		}
+		if stat, ok := statMap[string(entry.WorkTree)]; ok {
+			ws.Unstaged = append(ws.Unstaged, &DiffStat{Stat: stat, Filename: entry.Path})
+		}
+	}
+	return ws, nil
+}
+
+// DirtyReason summarizes why the working tree isn't clean, e.g.
+// "2 staged, 1 modified, 3 untracked". It's empty for a clean tree.
+func (r *Repo) DirtyReason() (string, error) {
+	entries, err := r.Status()
+	if err != nil {
+		return "", err
+	}
+	var staged, modified, untracked, conflicted int
+	for _, entry := range entries {
+		switch {
+		case entry.Index == '?':
+			untracked++
+		case entry.Index == 'U' || entry.WorkTree == 'U' || (entry.Index == 'A' && entry.WorkTree == 'A') || (entry.Index == 'D' && entry.WorkTree == 'D'):
+			conflicted++
+		default:
+			if entry.Index != ' ' {
+				staged++
+			}
+			if entry.WorkTree != ' ' {
+				modified++
+			}
+		}
+	}
+	var parts []string
+	for _, count := range []struct {
+		n    int
+		what string
+	}{{conflicted, "conflicted"}, {staged, "staged"}, {modified, "modified"}, {untracked, "untracked"}} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.what))
+		}
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// PlanAddCommitPush reports what AddCommitPush would do, without changing
+// anything
+func (r *Repo) PlanAddCommitPush() (*Plan, error) {
+	entries, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	for _, entry := range entries {
+		plan.Files = append(plan.Files, entry.Path)
+	}
+	plan.Commit = len(plan.Files) > 0
+	plan.Upstream, err = r.upstream()
+	if err != nil {
+		if errors.Cause(err) != ErrNoUpstream {
+			return nil, err
+		}
+	} else {
+		plan.Ahead, _, err = r.aheadBehind("HEAD", "@{u}")
+		if err != nil {
+			return nil, err
+		}
+	}
+	plan.Push = plan.Commit || plan.Ahead > 0
+	return plan, nil
+}
+
+// Stash saves the changes to tracked files as a new stash with message and
+// reverts them in the working tree. ErrNoLocalChanges is returned when
+// there is nothing to stash.
+func (r *Repo) Stash(message string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	dirty, err := r.hasLocalChanges()
+	if err != nil {
+		return err
+	}
+	if !dirty {
+		return ErrNoLocalChanges
+	}
+	_ = level.Debug(r.logger).Log("msg", "stashing changes", "message", message)
+	_, err = r.doGitEnv(r.opts.identityEnv(), "stash", "push", "-m", message)
+	return err
+}
+
+// StashPop applies the most recent stash and removes it. When it conflicts
+// the cause of the error is ErrStashConflict.
+func (r *Repo) StashPop() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	ref, err := r.stashRef(0)
+	if err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "popping stash", "stash", ref)
+	if _, err := r.doGit("stash", "pop", ref); err != nil {
+		if conflicted, _ := r.hasConflicts(); conflicted {
+			return errors.Wrap(ErrStashConflict, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// StashList returns the stashes, most recent first
+func (r *Repo) StashList() ([]StashEntry, error) {
+	if _, err := r.revParse("refs/stash"); err != nil {
+		return nil, nil
+	}
+	records, err := r.logRecords(&r.opts, []string{"log", "-g", "refs/stash"}, "%H", "%gs")
+	if err != nil {
+		return nil, err
+	}
+	var entries []StashEntry
+	for i, fields := range records {
+		entries = append(entries, StashEntry{Index: i, Commit: fields[0], Message: fields[1]})
+	}
+	return entries, nil
+}
+
+// StashApply applies the stash at index, where 0 is the most recent
+// stash, and keeps it on the stash list
+func (r *Repo) StashApply(index int) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	ref, err := r.stashRef(index)
+	if err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "applying stash", "stash", ref)
+	_, err = r.doGit("stash", "apply", ref)
+	return err
+}
+
+// StashDrop removes the stash at index from the stash list
+func (r *Repo) StashDrop(index int) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	ref, err := r.stashRef(index)
+	if err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "dropping stash", "stash", ref)
+	_, err = r.doGit("stash", "drop", ref)
+	return err
+}
+
+// StashClear removes all stashes
+func (r *Repo) StashClear() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "clearing stashes")
+	_, err := r.doGit("stash", "clear")
+	return err
+}
+
+// stashRef returns the ref of the stash at index, or ErrNoSuchStash
+func (r *Repo) stashRef(index int) (string, error) {
+	ref := fmt.Sprintf("stash@{%d}", index)
+	if index < 0 {
+		return "", ErrNoSuchStash
+	}
+	if _, err := r.revParse(ref); err != nil {
+		return "", ErrNoSuchStash
+	}
+	return ref, nil
+}
+
+// Merge merges branch into the current branch. When there are conflicts a
+// *MergeConflictError is returned and the merge is left in progress, to be
+// resolved and committed or aborted with AbortMerge.
+func (r *Repo) Merge(branch string, options ...SetOptFunc) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	opts := r.callOpts(options)
+	cmd, err := opts.mergeDriverArgs()
+	if err != nil {
+		return err
+	}
+	cmd = append(cmd, "merge", "--no-edit")
+	if opts.MergeNoFF {
+		cmd = append(cmd, "--no-ff")
+	}
+	if opts.MergeFFOnly {
+		cmd = append(cmd, "--ff-only")
+	}
+	if opts.MergeMessage != "" {
+		cmd = append(cmd, "-m", opts.MergeMessage)
+	}
+	if opts.NoGPGSign {
+		cmd = append(cmd, "--no-gpg-sign")
+	}
+	_ = level.Debug(r.logger).Log("msg", "merging", "branch", branch)
+	if _, err := r.doGitEnv(opts.identityEnv(), append(cmd, branch)...); err != nil {
+		if files, _ := r.ConflictedFiles(); len(files) > 0 {
+			return &MergeConflictError{Files: files}
+		}
+		if opts.MergeFFOnly && strings.Contains(err.Error(), "Not possible to fast-forward") {
+			return errors.Wrap(ErrNotFastForward, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// AbortMerge aborts a merge that stopped on conflicts and restores the
+// state from before the merge
+func (r *Repo) AbortMerge() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_, err := r.doGit("merge", "--abort")
+	return err
+}
+
+// SquashMerge merges branch into the current branch as a single commit
+// with msg. A *MergeConflictError is returned, without committing, when
+// the merge conflicts.
+func (r *Repo) SquashMerge(branch, msg string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	drivers, err := r.opts.mergeDriverArgs()
+	if err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "squash merging", "branch", branch)
+	if _, err := r.doGitEnv(r.opts.identityEnv(), append(drivers, "merge", "--squash", branch)...); err != nil {
+		if files, _ := r.ConflictedFiles(); len(files) > 0 {
+			return &MergeConflictError{Files: files}
+		}
+		return err
+	}
+	_, err = r.Commit(msg)
+	return err
+}
+
+// Replay cherry-picks the commits in from..to onto the current branch,
+// oldest first. When a commit conflicts a *CherryPickConflictError is
+// returned and the remaining commits are not applied yet.
+func (r *Repo) Replay(from, to string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "replaying commits", "from", from, "to", to)
+	drivers, err := r.opts.mergeDriverArgs()
+	if err != nil {
+		return err
+	}
+	_, err = r.doGitEnv(r.opts.identityEnv(), append(drivers, "cherry-pick", from+".."+to)...)
+	return r.cherryPickErr(err)
+}
+
+// ReplayContinue commits the resolved conflicts of a Replay that stopped
+// and applies the rest of its commits
+func (r *Repo) ReplayContinue() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	// keep the original message instead of starting an editor
+	drivers, err := r.opts.mergeDriverArgs()
+	if err != nil {
+		return err
+	}
+	env := append([]string{"GIT_EDITOR=true"}, r.opts.identityEnv()...)
+	_, err = r.doGitEnv(env, append(drivers, "cherry-pick", "--continue")...)
+	return r.cherryPickErr(err)
+}
+
+// ReplayAbort stops a Replay that stopped on a conflict and restores the
+// branch to what it was before the Replay
+func (r *Repo) ReplayAbort() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_, err := r.doGit("cherry-pick", "--abort")
+	return err
+}
+
+// cherryPickErr turns the error of a cherry-pick that stopped on a
+// conflict into a *CherryPickConflictError. Other errors, e.g. a missing
+// identity, are returned as they are.
+func (r *Repo) cherryPickErr(err error) error {
+	if err == nil || !r.gitPathExists("CHERRY_PICK_HEAD") {
+		return err
+	}
+	files, _ := r.ConflictedFiles()
+	if len(files) == 0 {
+		return err
+	}
+	commit, revErr := r.revParse("CHERRY_PICK_HEAD")
+	if revErr != nil {
+		return err
+	}
+	return &CherryPickConflictError{Commit: commit, Files: files}
+}
+
+func (r *Repo) Checkout(b string, options ...SetOptFunc) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	opts := r.callOpts(options)
+	_ = level.Debug(r.logger).Log("msg", "checkout", "branch", b, "force", opts.ForceCheckout)
+	cmd := []string{"checkout"}
+	if opts.ForceCheckout {
+		cmd = append(cmd, "-f")
+	}
+	_, err := r.doGit(append(cmd, b)...)
+	return err
+}
+
+// AddHunks stages only the hunks of the unstaged changes to path at
+// hunkIndexes, where 0 is the first hunk of git diff path
+func (r *Repo) AddHunks(path string, hunkIndexes []int) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	diff, err := r.doGit("diff", "--no-color", "--no-ext-diff", "--", path)
+	if err != nil {
+		return err
+	}
+	header, hunks := splitHunks(diff)
+	if len(hunks) == 0 {
+		return errors.New("no unstaged changes to " + path)
+	}
+	patch := header
+	for _, i := range hunkIndexes {
+		if i < 0 || i >= len(hunks) {
+			return errors.Errorf("hunk %d out of range, %s has %d hunks", i, path, len(hunks))
+		}
+	}
+	// keep the hunks in the order of the diff, whatever the order of the
+	// indexes
+	for i, hunk := range hunks {
+		for _, selected := range hunkIndexes {
+			if i == selected {
+				patch += hunk
+				break
+			}
+		}
+	}
+	_ = level.Debug(r.logger).Log("msg", "staging hunks", "path", path, "hunks", fmt.Sprint(hunkIndexes))
+	_, err = r.doGitInput(strings.NewReader(patch), "apply", "--cached", "--recount", "-")
+	return err
+}
+
+// splitHunks splits the diff of a single file into its header and its
+// hunks, which start at the "@@" lines
+func splitHunks(diff string) (string, []string) {
+	var header string
+	var hunks []string
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			hunks = append(hunks, line)
+		case len(hunks) == 0:
+			header += line
+		default:
+			hunks[len(hunks)-1] += line
+		}
+	}
+	return header, hunks
+}
+
+// CheckoutIndex discards the unstaged changes to paths by restoring them
+// from the index. Without paths all tracked files are restored.
+func (r *Repo) CheckoutIndex(paths ...string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	_ = level.Debug(r.logger).Log("msg", "restoring paths from index", "paths", strings.Join(paths, " "))
+	_, err := r.doGit(append([]string{"checkout", "--"}, paths...)...)
+	return err
+}
+
+// FastForwardRef moves branch to the commit to without checking it out,
+// but only if that is a fast-forward. Otherwise ErrNotFastForward is returned.
+func (r *Repo) FastForwardRef(branch, to string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	current, err := r.Branch()
+	if err != nil {
+		return err
+	}
+	if current == branch {
+		return errors.New("cannot fast-forward the checked out branch " + branch)
+	}
+	oldSHA, err := r.revParse("refs/heads/" + branch)
+	if err != nil {
+		return err
+	}
+	newSHA, err := r.revParse(to + "^{commit}")
+	if err != nil {
+		return err
+	}
+	ok, err := r.isAncestor(oldSHA, newSHA)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFastForward
+	}
+	_ = level.Debug(r.logger).Log("msg", "fast-forwarding branch", "branch", branch, "to", to)
+	_, err = r.doGit("update-ref", "refs/heads/"+branch, newSHA, oldSHA)
+	return err
+}
+
+// BranchStatus returns the tracking state of every local branch. Branches
+// without an upstream have an empty Upstream.
+func (r *Repo) BranchStatus() ([]BranchTrack, error) {
+	out, err := r.doGit("for-each-ref", "--format=%(refname:short)%00%(upstream:short)%00%(upstream:track)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	var tracks []BranchTrack
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+		bt := BranchTrack{
+			Branch:   fields[0],
+			Upstream: fields[1],
+		}
+		// the track field looks like "[ahead 1, behind 2]" or "[gone]"
+		track := strings.Trim(fields[2], "[]")
+		for _, part := range strings.Split(track, ", ") {
+			var n int
+			if part == "gone" {
+				bt.Gone = true
+			} else if _, err := fmt.Sscanf(part, "ahead %d", &n); err == nil {
+				bt.Ahead = n
+			} else if _, err := fmt.Sscanf(part, "behind %d", &n); err == nil {
+				bt.Behind = n
+			}
+		}
+		tracks = append(tracks, bt)
+	}
+	return tracks, nil
+}
+
+// Branch returns the current branch, or "HEAD" when HEAD is detached
+func (r *Repo) Branch() (string, error) {
+	out, err := r.doGit("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get branch info")
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Branches returns the names of the local branches
+func (r *Repo) Branches() ([]string, error) {
+	out, err := r.doGit("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	var branches []string
+	for _, branch := range strings.Split(out, "\n") {
+		if branch != "" {
+			branches = append(branches, branch)
+		}
+	}
+	return branches, nil
+}
+
+// CreateBranch creates the branch name at startPoint, or at HEAD when
+// startPoint is empty, without checking it out
+func (r *Repo) CreateBranch(name, startPoint string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	args := []string{"branch", "--", name}
+	if startPoint != "" {
+		args = append(args, startPoint)
+	}
+	_ = level.Debug(r.logger).Log("msg", "creating branch", "branch", name, "start", startPoint)
+	_, err := r.doGit(args...)
+	return err
+}
+
+// DeleteBranch deletes the branch name. Without force it's only deleted
+// when it's merged.
+func (r *Repo) DeleteBranch(name string, force bool) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	flag := "-d"
+	if force {
+		flag = "-D"
+	}
+	_ = level.Debug(r.logger).Log("msg", "deleting branch", "branch", name, "force", force)
+	_, err := r.doGit("branch", flag, "--", name)
+	return err
+}
+
+// CheckoutNew creates the branch name at HEAD and checks it out
+func (r *Repo) CheckoutNew(name string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "checking out new branch", "branch", name)
+	_, err := r.doGit("checkout", "-b", name)
+	return err
+}
+
+// CurrentRef returns the current branch, or the short hash of the commit
+// that is checked out with detached set when HEAD is detached, e.g. after
+// checking out a tag
+func (r *Repo) CurrentRef() (ref string, detached bool, err error) {
+	out, err := r.doGit("symbolic-ref", "--quiet", "--short", "HEAD")
+	if err == nil {
+		return strings.TrimSpace(out), false, nil
+	}
+	if exitCode(err) != 1 {
+		return "", false, err
+	}
+	out, err = r.doGit("rev-parse", "--short", "HEAD")
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(out), true, nil
+}
+
+// MergedBranches returns the local branches that are merged into into,
+// leaving out into itself and the current branch
+func (r *Repo) MergedBranches(into string) ([]string, error) {
+	out, err := r.doGit("for-each-ref", "--merged="+into, "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := r.CurrentRef()
+	if err != nil {
+		return nil, err
+	}
+	var branches []string
+	for _, branch := range strings.Split(out, "\n") {
+		if branch == "" || branch == into || branch == current {
+			continue
+		}
+		branches = append(branches, branch)
+	}
+	return branches, nil
+}
+
+// DeleteMergedBranches deletes the branches returned by MergedBranches and
+// returns the ones it deleted
+func (r *Repo) DeleteMergedBranches(into string) ([]string, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	branches, err := r.MergedBranches(into)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, branch := range branches {
+		_ = level.Debug(r.logger).Log("msg", "deleting merged branch", "branch", branch, "into", into)
+		// -d would check whether it's merged into HEAD instead of into
+		if _, err := r.doGit("branch", "-D", branch); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, branch)
+	}
+	return deleted, nil
+}
+
+// SetStateRef stores sha as refs/state/name, e.g. to remember the last
+// commit that was processed. sha can be any revision, it's stored resolved.
+func (r *Repo) SetStateRef(name, sha string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	commit, err := r.revParse(sha)
+	if err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "setting state ref", "name", name, "sha", commit)
+	_, err = r.doGit("update-ref", "-m", "gogit: set state", "refs/state/"+name, commit)
+	return err
+}
+
+// GetStateRef returns the SHA stored with SetStateRef as name, or
+// ErrNoSuchStateRef
+func (r *Repo) GetStateRef(name string) (string, error) {
+	out, err := r.doGit("rev-parse", "--verify", "--quiet", "refs/state/"+name)
+	if err != nil {
+		if exitCode(err) == 1 {
+			return "", errors.Wrap(ErrNoSuchStateRef, name)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (r *Repo) CurrentCommit() (string, error) {
+	// git rev-parse HEAD
+	out, err := r.doGit("rev-parse", "HEAD")
+	if err != nil { return "", err }
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+var statMap = map[string]ModType{
+	"A": StatNew,
+	"M": StatModified,
+	"D": StatDeleted,
+	"R": StatRenamed,
+	"C": StatCopied,
+}
+
+// DiffStatus returns the status of each file that differs between two
+// commits. Renames are detected, which can be tuned with SetFindRenames
+// and SetFindCopies.
+func (r *Repo) DiffStatus(c1, c2 string, options ...SetOptFunc) ([]*DiffStat, error) {
+	args := append([]string{"diff", "--name-status", "-z"}, r.callOpts(options).renameArgs()...)
+	out, err := r.doGit(append(args, c1, c2)...)
+	if err != nil { return nil, err }
+	var ok bool
+	var diffs []*DiffStat
+	// entries are "status\0path\0", renames and copies are
+	// "status\0oldpath\0path\0" with a similarity score, e.g. R100
+	fields := strings.Split(out, "\x00")
+	for i := 0; i+1 < len(fields); i++ {
+		status := fields[i]
+		if status == "" {
+			continue
+		}
+		var ds DiffStat
+		if ds.Stat, ok = statMap[status[:1]]; !ok {
+			// no idea what this is, skip it and its path
+			i++
+			continue
+		}
+		if ds.Stat == StatRenamed || ds.Stat == StatCopied {
+			if i+2 >= len(fields) {
+				break
+			}
+			ds.OldFilename = fields[i+1]
+			ds.Filename = fields[i+2]
+			i += 2
+		} else {
+			ds.Filename = fields[i+1]
+			i++
+		}
+		diffs = append(diffs, &ds)
+	}
+	return diffs, err
+}
+
+// FileChanged checks whether the file or directory at path differs
+// between two commits
+func (r *Repo) FileChanged(path, c1, c2 string) (bool, error) {
+	_, err := r.doGit("diff", "--quiet", c1, c2, "--", path)
+	if err == nil {
+		return false, nil
+	}
+	if exitCode(err) == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// Log returns the commits selected by opts, newest first
+func (r *Repo) Log(opts LogOpts) ([]*Commit, error) {
+	args := []string{"log"}
+	if opts.MaxCount > 0 {
+		args = append(args, "-n", strconv.Itoa(opts.MaxCount))
+	}
+	if opts.Since != "" {
+		args = append(args, "--since="+opts.Since)
+	}
+	if opts.Range != "" {
+		args = append(args, opts.Range)
+	}
+	if opts.Path != "" {
+		args = append(args, "--", opts.Path)
+	}
+	return r.logCommits(&r.opts, args)
+}
+
+// ChangelogCommits returns the commits in to that are not in from, newest
+// first. With an empty from all commits reachable from to are returned.
+func (r *Repo) ChangelogCommits(from, to string, opts ChangelogOpts) ([]*Commit, error) {
+	args := []string{"log"}
+	if opts.NoMerges {
+		args = append(args, "--no-merges")
+	}
+	if opts.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	if from == "" {
+		args = append(args, to)
+	} else {
+		args = append(args, from+".."+to)
+	}
+	if opts.Path != "" {
+		args = append(args, "--", opts.Path)
+	}
+	return r.logCommits(&r.opts, args)
+}
+
+// Remotes returns the fetch URL of every remote by name
+func (r *Repo) Remotes() (map[string]string, error) {
+	out, err := r.doGit("remote")
+	if err != nil {
+		return nil, err
+	}
+	remotes := make(map[string]string)
+	for _, name := range strings.Fields(out) {
+		url, err := r.RemoteURL(name)
+		if err != nil {
+			return nil, err
+		}
+		remotes[name] = url
+	}
+	return remotes, nil
+}
+
+// AddRemote adds the remote name with url
+func (r *Repo) AddRemote(name, url string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "adding remote", "remote", name)
+	_, err := r.doGit("remote", "add", "--", name, url)
+	return err
+}
+
+// SetRemoteURL changes the URL of the remote name
+func (r *Repo) SetRemoteURL(name, url string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "setting remote url", "remote", name)
+	_, err := r.doGit("remote", "set-url", "--", name, url)
+	return err
+}
+
+// RemoveRemote removes the remote name and its remote-tracking branches
+func (r *Repo) RemoveRemote(name string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "removing remote", "remote", name)
+	_, err := r.doGit("remote", "remove", "--", name)
+	return err
+}
+
+// RemoteURL returns the fetch URL of remote
+func (r *Repo) RemoteURL(remote string) (string, error) {
+	out, err := r.doGit("remote", "get-url", remote)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// UpstreamURL returns the URL of the remote the current branch tracks,
+// which isn't necessarily origin. The cause of the error is ErrNoUpstream
+// when the branch doesn't track a remote branch.
+func (r *Repo) UpstreamURL() (string, error) {
+	out, err := r.doGit("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", errors.Wrap(ErrNoUpstream, "not on a branch")
+	}
+	branch := strings.TrimSpace(out)
+	out, err = r.doGit("config", "--get", "branch."+branch+".remote")
+	if err != nil {
+		return "", errors.Wrap(ErrNoUpstream, "branch "+branch+" has no remote")
+	}
+	remote := strings.TrimSpace(out)
+	if remote == "." {
+		return "", errors.Wrap(ErrNoUpstream, "branch "+branch+" tracks a local branch")
+	}
+	return r.RemoteURL(remote)
+}
+
+// PatchID returns the stable patch-id of commit, which is the same for
+// commits that make the same change, e.g. a commit and its cherry-pick.
+// ErrMergeCommit is returned for merge commits.
+func (r *Repo) PatchID(commit string) (string, error) {
+	out, err := r.doGit("rev-list", "--parents", "-n", "1", commit)
+	if err != nil {
+		return "", err
+	}
+	if len(strings.Fields(out)) > 2 {
+		return "", errors.Wrap(ErrMergeCommit, commit)
+	}
+	patch, err := r.doGit("show", "--format=", commit)
+	if err != nil {
+		return "", err
+	}
+	idOut, err := r.doGitInput(strings.NewReader(patch), "patch-id", "--stable")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(idOut))
+	if len(fields) == 0 {
+		return "", errors.New("commit " + commit + " has no changes")
+	}
+	return fields[0], nil
+}
+
+// SearchIntroduced returns the commits that added or removed term, newest
+// first. If isRegex is set, term is a regular expression matched against
+// the changed lines instead.
+func (r *Repo) SearchIntroduced(term string, isRegex bool, options ...SetOptFunc) ([]*Commit, error) {
+	pickaxe := "-S" + term
+	if isRegex {
+		pickaxe = "-G" + term
+	}
+	return r.logCommits(r.callOpts(options), []string{"log", pickaxe})
+}
+
+// logCommits runs a git log like command and parses the commits
+func (r *Repo) logCommits(opts *GitOpts, args []string) ([]*Commit, error) {
+	records, err := r.logRecords(opts, args, "%H", "%an", "%ae", "%aI", "%s", "%(trailers:only,unfold)")
+	if err != nil {
+		return nil, err
+	}
+	var commits []*Commit
+	for _, fields := range records {
+		date, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected date for commit "+fields[0])
+		}
+		commits = append(commits, &Commit{
+			Hash:        fields[0],
+			AuthorName:  fields[1],
+			AuthorEmail: fields[2],
+			Date:        date,
+			Subject:     fields[4],
+			Trailers:    parseTrailers(fields[5]),
+		})
+	}
+	return commits, nil
+}
+
+// parseTrailers parses "Key: value" lines as output by %(trailers)
+func parseTrailers(out string) map[string][]string {
+	var trailers map[string][]string
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if trailers == nil {
+			trailers = make(map[string][]string)
+		}
+		key := strings.TrimSpace(parts[0])
+		trailers[key] = append(trailers[key], strings.TrimSpace(parts[1]))
+	}
+	return trailers
+}
+
+// logRecords runs a git log like command with a format made up of the
+// given placeholders and returns the fields of each commit
+func (r *Repo) logRecords(opts *GitOpts, args []string, placeholders ...string) ([][]string, error) {
+	rs, fs := opts.LogRecordSeparator, opts.LogFieldSeparator
+	if rs == "" {
+		rs = "\x1e"
+	}
+	if fs == "" {
+		fs = "\x1f"
+	}
+	// the format goes right after the subcommand, so it ends up before
+	// any "--" separating paths
+	format := "--format=" + rs + strings.Join(placeholders, fs)
+	cmd := append([]string{args[0], format}, args[1:]...)
+	out, err := r.doGit(cmd...)
+	if err != nil {
+		return nil, err
+	}
+	var records [][]string
+	for _, record := range strings.Split(out, rs)[1:] {
+		fields := strings.Split(strings.TrimSuffix(record, "\n"), fs)
+		if len(fields) != len(placeholders) {
+			return nil, errors.New("unexpected git log output, try other log separators")
+		}
+		records = append(records, fields)
+	}
+	return records, nil
+}
+
+// CommitFiles returns the files changed by commit compared to its first
+// parent. For a root commit all its files are returned as new.
+func (r *Repo) CommitFiles(commit string, options ...SetOptFunc) ([]*DiffStat, error) {
+	parent, err := r.revParse(commit + "^")
+	if err != nil {
+		// no parent, so compare to the empty tree instead
+		out, err := r.doGit("hash-object", "-t", "tree", "/dev/null")
+		if err != nil {
+			return nil, err
+		}
+		parent = strings.TrimSpace(out)
+	}
+	return r.DiffStatus(parent, commit, options...)
+}
+
+// DiffNumstat returns the number of added and deleted lines per file
+// between two commits. Renames are detected the same way as in DiffStatus.
+func (r *Repo) DiffNumstat(c1, c2 string, options ...SetOptFunc) ([]*DiffNumstat, error) {
+	args := append([]string{"diff", "--numstat", "-z"}, r.callOpts(options).renameArgs()...)
+	out, err := r.doGit(append(args, c1, c2)...)
+	if err != nil {
+		return nil, err
+	}
+	// With -z each entry is "added\tdeleted\tpath\0", or for renames and copies
+	// "added\tdeleted\t\0oldpath\0newpath\0"
+	var stats []*DiffNumstat
+	entries := strings.Split(out, "\x00")
+	for i := 0; i < len(entries); i++ {
+		fields := strings.SplitN(entries[i], "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		ns := DiffNumstat{Filename: fields[2]}
+		if fields[0] == "-" && fields[1] == "-" {
+			ns.Binary = true
+		} else {
+			if ns.Added, err = strconv.Atoi(fields[0]); err != nil {
+				return nil, errors.Wrap(err, "unexpected numstat output")
+			}
+			if ns.Deleted, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, errors.Wrap(err, "unexpected numstat output")
+			}
+		}
+		if ns.Filename == "" {
+			if i+2 >= len(entries) {
+				return nil, errors.New("unexpected numstat output")
+			}
+			ns.OldFilename = entries[i+1]
+			ns.Filename = entries[i+2]
+			i += 2
+		}
+		stats = append(stats, &ns)
+	}
+	return stats, nil
+}
+
+// BinaryChangedFiles returns the files that differ between two commits
+// and that git considers binary
+func (r *Repo) BinaryChangedFiles(c1, c2 string) ([]string, error) {
+	stats, err := r.DiffNumstat(c1, c2)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, ns := range stats {
+		if ns.Binary {
+			files = append(files, ns.Filename)
+		}
+	}
+	return files, nil
+}
+
+// ReleaseDiff reports all files that differ between tag and HEAD, with
+// their status and line counts, plus the line totals over all files.
+func (r *Repo) ReleaseDiff(tag string, options ...SetOptFunc) (*ReleaseDiffReport, error) {
+	diffs, err := r.DiffStatus(tag, "HEAD", options...)
+	if err != nil {
+		return nil, err
+	}
+	numstats, err := r.DiffNumstat(tag, "HEAD", options...)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*DiffNumstat, len(numstats))
+	for _, ns := range numstats {
+		byName[ns.Filename] = ns
+	}
+	report := &ReleaseDiffReport{Tag: tag}
+	for _, ds := range diffs {
+		f := &ReleaseDiffFile{DiffStat: *ds}
+		if ns, ok := byName[ds.Filename]; ok {
+			f.Added = ns.Added
+			f.Deleted = ns.Deleted
+			f.Binary = ns.Binary
+		}
+		report.Added += f.Added
+		report.Deleted += f.Deleted
+		report.Files = append(report.Files, f)
+	}
+	return report, nil
+}
+
+// ShowDeletedFile fetches the last version of a file, from just
+// before it got deleted from the current repo and branch
+func (r *Repo) ShowDeletedFile(path string) (string, error) {
+	// the most recent commit is the one deleting the file, the one
+	// before that has its last version
+	commits, err := r.logCommits(&r.opts, []string{"log", "--full-history", "-2", "--", path})
+	if err != nil {
+		return "", err
+	}
+	if len(commits) < 2 {
+		return "", errors.New("no earlier version of " + path + " found")
+	}
+	return r.ShowForCommit(commits[1].Hash, path)
+}
+
+// FileVersions returns up to max versions of the file at path, newest first,
+// following it across renames. Commits that deleted the file are skipped.
+func (r *Repo) FileVersions(path string, max int) ([]FileVersion, error) {
+	args := []string{"log", "--follow", "--diff-filter=d", "--name-only", "--format=%x00%H %cI"}
+	if max > 0 {
+		args = append(args, "-n", strconv.Itoa(max))
+	}
+	out, err := r.doGit(append(args, "--", path)...)
+	if err != nil {
+		return nil, err
+	}
+	// Each entry is "\0<hash> <date>\n\n<path at that commit>\n"
+	var versions []FileVersion
+	for _, entry := range strings.Split(out, "\x00") {
+		lines := strings.Split(strings.TrimSpace(entry), "\n")
+		header := strings.Fields(lines[0])
+		if len(lines) < 2 || len(header) != 2 {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, header[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected date in git log output")
+		}
+		content, err := r.ShowForCommit(header[0], lines[len(lines)-1])
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, FileVersion{
+			Commit:  header[0],
+			Date:    date,
+			Content: content,
+		})
+	}
+	return versions, nil
+}
+
+// TreeEntries lists the entries of the directory at path, without
+// descending into subdirectories. An empty path lists the root.
+func (r *Repo) TreeEntries(ref, dir string) ([]TreeEntry, error) {
+	args := []string{"ls-tree", "-z", ref}
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		args = append(args, "--", dir+"/")
+	}
+	out, err := r.doGit(args...)
+	if err != nil {
+		return nil, err
+	}
+	// entries are "<mode> <type> <sha>\t<path>\0"
+	var entries []TreeEntry
+	for _, line := range strings.Split(out, "\x00") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		if len(fields) != 3 {
+			return nil, errors.New("unexpected output from git ls-tree: " + line)
+		}
+		entries = append(entries, TreeEntry{
+			Mode: fields[0],
+			Type: fields[1],
+			SHA:  fields[2],
+			Name: path.Base(parts[1]),
+		})
+	}
+	return entries, nil
+}
+
+// ShowForCommit returns the content of the file at path as of commit
+//
+// Deprecated: use ShowFile, which also works for binary files
+func (r *Repo) ShowForCommit(commit, path string) (string, error) {
+	return r.doGit("show", fmt.Sprintf("%s:%s", commit, path))
+}
+
+// ShowFile returns the content of the file at path as of rev, which can
+// be any revision like a branch, a tag or a commit
+func (r *Repo) ShowFile(rev, path string) ([]byte, error) {
+	return r.doGitStdout("cat-file", "blob", rev+":"+path)
+}
+
+// CatFile returns the content of the object sha, pretty-printed according
+// to its type: the content of a blob, the entries of a tree or the text of
+// a commit or tag. Use CatFileType to get the type.
+func (r *Repo) CatFile(sha string) ([]byte, error) {
+	return r.doGitStdout("cat-file", "-p", sha)
+}
+
+// CatFileType returns the type of the object sha: "blob", "tree",
+// "commit" or "tag"
+func (r *Repo) CatFileType(sha string) (string, error) {
+	out, err := r.doGit("cat-file", "-t", sha)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// FileExistsAt checks whether path exists in the tree of rev. An error is
+// only returned when rev itself can't be resolved.
+func (r *Repo) FileExistsAt(rev, path string) (bool, error) {
+	if _, err := r.revParse(rev + "^{tree}"); err != nil {
+		return false, err
+	}
+	_, err := r.doGit("rev-parse", "--verify", "--quiet", rev+":"+path)
+	if err == nil {
+		return true, nil
+	}
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// IsClean checks whether the working tree has no local changes and the
+// current branch is in sync with its upstream as last fetched. It doesn't
+// fetch, call Fetch first to compare with the current state of the remote.
+// Errors are logged and make the repo count as not clean.
+func (r *Repo) IsClean() (bool) {
+	clean, err := r.workTreeClean()
+	if err != nil {
+		_ = level.Warn(r.logger).Log("msg", "failed to get status", "err", err)
+		return false
+	}
+	if !clean {
+		reason, _ := r.DirtyReason()
+		_ = level.Debug(r.logger).Log("msg", "working tree not clean", "reason", reason)
+		return false
+	}
+	if _, err := r.upstream(); err != nil {
+		// nothing to be in sync with
+		return true
+	}
+	ahead, behind, err := r.aheadBehind("HEAD", "@{u}")
+	if err != nil {
+		_ = level.Warn(r.logger).Log("msg", "failed to compare with upstream", "err", err)
+		return false
+	}
+	return ahead == 0 && behind == 0
+}
+
+// MatchesCommit checks whether HEAD is at commit and the working tree has
+// no local changes
+func (r *Repo) MatchesCommit(commit string) (bool, error) {
+	head, err := r.CurrentCommit()
+	if err != nil {
+		return false, err
+	}
+	want, err := r.revParse(commit + "^{commit}")
+	if err != nil {
+		return false, err
+	}
+	if head != want {
+		return false, nil
+	}
+	return r.workTreeClean()
+}
+
+// ConflictedFiles returns the files with unresolved conflicts, e.g. after
+// a failed merge, rebase or pull
+func (r *Repo) ConflictedFiles() ([]string, error) {
+	out, err := r.doGit("diff", "--name-only", "-z", "--diff-filter=U")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// ResolveUsing resolves the conflict in path by taking the whole file from
+// side, and marks it as resolved
+func (r *Repo) ResolveUsing(path string, side ResolveSide) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	flag := "--ours"
+	if side == Theirs {
+		flag = "--theirs"
+	}
+	_ = level.Debug(r.logger).Log("msg", "resolving conflict", "path", path, "side", flag)
+	if _, err := r.doGit("checkout", flag, "--", path); err != nil {
+		return err
+	}
+	_, err := r.doGit("add", "--", path)
+	return err
+}
+
+// ConflictHunks parses the conflict markers in a conflicted file into
+// the ours, base and theirs sections of each conflict
+func (r *Repo) ConflictHunks(path string) ([]ConflictHunk, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.RepoDir, path))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read conflicted file "+path)
+	}
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	var hunks []ConflictHunk
+	var hunk ConflictHunk
+	var section *string
+	state := outside
+	for i, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case state == outside && strings.HasPrefix(trimmed, "<<<<<<<"):
+			hunk = ConflictHunk{StartLine: i + 1, OursLabel: markerLabel(trimmed)}
+			section, state = &hunk.Ours, inOurs
+		case state == inOurs && strings.HasPrefix(trimmed, "|||||||"):
+			hunk.BaseLabel = markerLabel(trimmed)
+			section, state = &hunk.Base, inBase
+		case (state == inOurs || state == inBase) && trimmed == "=======":
+			section, state = &hunk.Theirs, inTheirs
+		case state == inTheirs && strings.HasPrefix(trimmed, ">>>>>>>"):
+			hunk.EndLine = i + 1
+			hunk.TheirsLabel = markerLabel(trimmed)
+			hunks = append(hunks, hunk)
+			section, state = nil, outside
+		case section != nil:
+			*section += line
+		}
+	}
+	if state != outside {
+		return nil, errors.New("unterminated conflict in " + path)
+	}
+	return hunks, nil
+}
+
+func markerLabel(line string) string {
+	return strings.TrimSpace(line[7:])
+}
+
+// ExportRef writes the tree at ref into destDir, keeping file modes,
+// without touching the working tree of the repo
+func (r *Repo) ExportRef(ref, destDir string) error {
+	_ = level.Debug(r.logger).Log("msg", "exporting ref", "ref", ref, "dest", destDir)
+	r.cmdMu.Lock()
+	defer r.cmdMu.Unlock()
+	cmd := r.gitCmd(context.Background(), r.RepoDir, "archive", "--format=tar", ref)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to create pipe for git archive")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start git archive")
+	}
+	extractErr := extractTar(stdout, destDir)
+	// drain whatever is left so git doesn't block on a full pipe
+	_, _ = io.Copy(ioutil.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrap(err, "failed to run command 'git archive "+ref+"' on repo "+r.Name+": "+stderr.String())
+	}
+	return extractErr
+}
+
+// ArchiveSubtree writes an archive of the directory subdir of ref to w.
+// Paths in the archive are relative to subdir. format is any format git
+// archive supports, e.g. "tar" or "zip".
+func (r *Repo) ArchiveSubtree(ref, subdir string, w io.Writer, format string, options ...SetOptFunc) error {
+	opts := r.callOpts(options)
+	tree := ref + ":" + strings.Trim(subdir, "/")
+	args := []string{"archive", "--format=" + format}
+	if opts.ArchivePrefix != "" {
+		args = append(args, "--prefix="+opts.ArchivePrefix)
+	}
+	args = append(args, tree)
+	_ = level.Debug(r.logger).Log("msg", "archiving subtree", "tree", tree)
+	r.cmdMu.Lock()
+	defer r.cmdMu.Unlock()
+	cmd := r.gitCmd(context.Background(), r.RepoDir, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "failed to run command 'git "+strings.Join(args, " ")+"' on repo "+r.Name+": "+stderr.String())
+	}
+	return nil
+}
+
+func extractTar(rd io.Reader, destDir string) error {
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read archive")
+		}
+		target := filepath.Join(destDir, hdr.Name)
+		if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return errors.New("archive entry outside of destination: " + hdr.Name)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return errors.Wrap(err, "failed to create dir "+target)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.Wrap(err, "failed to create dir for "+target)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return errors.Wrap(err, "failed to create file "+target)
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return errors.Wrap(err, "failed to write file "+target)
+			}
+			if closeErr != nil {
+				return errors.Wrap(closeErr, "failed to write file "+target)
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.Wrap(err, "failed to create dir for "+target)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return errors.Wrap(err, "failed to create symlink "+target)
+			}
+		}
+	}
+}
+
+// AuthorStats returns the number of commits and changed lines per author
+// email for the commits between since and until, which can be any date
+// git log understands. Empty values leave the range open. Merge commits
+// are skipped and binary files don't count towards the lines.
+func (r *Repo) AuthorStats(since, until string) (map[string]AuthorStat, error) {
+	args := []string{"log", "--no-merges", "--numstat", "--format=%x00%ae"}
+	if since != "" {
+		args = append(args, "--since="+since)
+	}
+	if until != "" {
+		args = append(args, "--until="+until)
+	}
+	out, err := r.doGit(args...)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]AuthorStat)
+	for _, entry := range strings.Split(out, "\x00") {
+		lines := strings.Split(strings.TrimSpace(entry), "\n")
+		if lines[0] == "" {
+			continue
+		}
+		author := lines[0]
+		stat := stats[author]
+		stat.Commits++
+		for _, line := range lines[1:] {
+			fields := strings.SplitN(line, "\t", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			// binary files have "-" instead of line counts
+			if added, err := strconv.Atoi(fields[0]); err == nil {
+				stat.Added += added
+			}
+			if deleted, err := strconv.Atoi(fields[1]); err == nil {
+				stat.Deleted += deleted
+			}
+		}
+		stats[author] = stat
+	}
+	return stats, nil
+}
+
+// EnsureClean returns a *NotCleanError when the repo is in the middle of a
+// merge, rebase, cherry-pick or revert, or has uncommitted changes to
+// tracked files. Call it before automated operations to fail fast.
+func (r *Repo) EnsureClean() error {
+	if op := r.inProgress(); op != "" {
+		return &NotCleanError{InProgress: op}
+	}
+	out, err := r.doGit("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "" {
+		return &NotCleanError{Dirty: true}
+	}
+	return nil
+}
+
+// CommitGraph returns up to max commits reachable from any ref, newest
+// first, with their parents and decorations. Use max <= 0 for no limit.
+func (r *Repo) CommitGraph(max int, options ...SetOptFunc) ([]GraphNode, error) {
+	args := []string{"log", "--all", "--topo-order", "--decorate=full"}
+	if max > 0 {
+		args = append(args, "-n", strconv.Itoa(max))
+	}
+	records, err := r.logRecords(r.callOpts(options), args, "%H", "%P", "%D")
+	if err != nil {
+		return nil, err
+	}
+	var nodes []GraphNode
+	for _, fields := range records {
+		node := GraphNode{
+			Commit:  fields[0],
+			Parents: strings.Fields(fields[1]),
+		}
+		for _, ref := range strings.Split(fields[2], ", ") {
+			// decorations look like "HEAD -> refs/heads/master" or
+			// "tag: refs/tags/v1"
+			if strings.HasPrefix(ref, "HEAD -> ") {
+				node.Refs = append(node.Refs, "HEAD")
+				ref = strings.TrimPrefix(ref, "HEAD -> ")
+			}
+			ref = strings.TrimPrefix(ref, "tag: ")
+			if ref != "" {
+				node.Refs = append(node.Refs, ref)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Tags returns the names of all tags
+func (r *Repo) Tags() ([]string, error) {
+	out, err := r.doGit("tag", "--list")
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			tags = append(tags, line)
+		}
+	}
+	return tags, nil
+}
+
+// TagExists checks whether a tag with name exists
+func (r *Repo) TagExists(name string) (bool, error) {
+	_, err := r.doGit("show-ref", "--verify", "--quiet", "refs/tags/"+name)
+	if err == nil {
+		return true, nil
+	}
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// CreateTag creates an annotated tag with message at HEAD. With
+// SetLightweightTag a lightweight tag is created and message is ignored.
+// ErrTagExists is returned when the tag already exists.
+func (r *Repo) CreateTag(name, message string, options ...SetOptFunc) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	exists, err := r.TagExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.Wrap(ErrTagExists, name)
+	}
+	opts := r.callOpts(options)
+	args := append(opts.signingFormatArgs(), "tag")
+	if !opts.LightweightTag {
+		cleanup, err := opts.cleanupArgs()
+		if err != nil {
+			return err
+		}
+		if opts.TagTemplate != "" {
+			template, err := ioutil.ReadFile(opts.TagTemplate)
+			if err != nil {
+				return errors.Wrap(err, "failed to read tag template")
+			}
+			message = ApplyTemplate(string(template), message)
+		}
+		args = append(args, "-a", "-m", message)
+		args = append(args, cleanup...)
+		if opts.Sign {
+			if opts.SigningKey != "" {
+				args = append(args, "-u", opts.SigningKey)
+			} else {
+				args = append(args, "-s")
+			}
+		}
+	}
+	_ = level.Debug(r.logger).Log("msg", "creating tag", "tag", name, "lightweight", opts.LightweightTag)
+	// the tagger is the committer
+	_, err = r.doGitEnv(opts.identityEnv(), append(args, name)...)
+	return signingErr(opts, err)
+}
+
+// PushTags pushes tags to origin, or all tags when none are given
+func (r *Repo) PushTags(tags ...string) error {
+	opts := r.callOpts(nil)
+	if len(tags) == 0 {
+		_ = level.Debug(r.logger).Log("msg", "pushing all tags")
+		return r.push(context.Background(), opts, "origin", "--tags")
+	}
+	refspecs := []string{"origin"}
+	for _, tag := range tags {
+		refspecs = append(refspecs, "refs/tags/"+tag)
+	}
+	_ = level.Debug(r.logger).Log("msg", "pushing tags", "tags", strings.Join(tags, " "))
+	return r.push(context.Background(), opts, refspecs...)
+}
+
+// TagsOnBranch returns the tags that point at commits on branch, oldest
+// first
+func (r *Repo) TagsOnBranch(branch string) ([]TagInfo, error) {
+	out, err := r.doGit("for-each-ref", "--merged="+branch, "--sort=creatordate",
+		"--format=%(refname:short)%00%(objectname)%00%(*objectname)%00%(creatordate:iso-strict)", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+	return parseTagInfos(out)
+}
+
+func parseTagInfos(out string) ([]TagInfo, error) {
+	var tags []TagInfo
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 4 {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected date for tag "+fields[0])
+		}
+		tag := TagInfo{
+			Name:   fields[0],
+			Commit: fields[1],
+			Date:   date,
+		}
+		// annotated tags point at a tag object, which points at the commit
+		if fields[2] != "" {
+			tag.Commit = fields[2]
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// BlameAtRef returns the blame of the file at path as it was at ref
+func (r *Repo) BlameAtRef(path, ref string, options ...SetOptFunc) ([]BlameLine, error) {
+	return r.blame(r.callOpts(options), path, ref)
+}
+
+// Blame returns the blame of the file at path, as it is in the working
+// tree or at the revision set with SetBlameRev
+func (r *Repo) Blame(path string, options ...SetOptFunc) ([]BlameLine, error) {
+	opts := r.callOpts(options)
+	return r.blame(opts, path, opts.BlameRev)
+}
+
+func (r *Repo) blame(opts *GitOpts, path, ref string) ([]BlameLine, error) {
+	args := []string{"blame", "--porcelain"}
+	if opts.BlameMoves {
+		args = append(args, "-M")
+	}
+	if opts.BlameCopies {
+		args = append(args, "-C")
+	}
+	if opts.BlameStart > 0 {
+		lineRange := strconv.Itoa(opts.BlameStart) + ","
+		if opts.BlameEnd > 0 {
+			lineRange += strconv.Itoa(opts.BlameEnd)
+		}
+		args = append(args, "-L", lineRange)
+	}
+	if ref != "" {
+		args = append(args, ref)
+	}
+	out, err := r.doGit(append(args, "--", path)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlame(out)
+}
+
+// parseBlame parses git blame --porcelain output. Each line starts with a
+// header "<sha> <orig line> <line> [<count>]", followed by information on
+// the commit the first time it shows up, and the tab prefixed content.
+func parseBlame(out string) ([]BlameLine, error) {
+	var lines []BlameLine
+	commits := make(map[string]*BlameLine)
+	var cur *BlameLine
+	for _, line := range strings.Split(out, "\n") {
+		if cur == nil {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			cur = &BlameLine{Commit: fields[0]}
+			cur.OrigLine, _ = strconv.Atoi(fields[1])
+			cur.LineNo, _ = strconv.Atoi(fields[2])
+			if known, ok := commits[cur.Commit]; ok {
+				cur.AuthorName = known.AuthorName
+				cur.AuthorEmail = known.AuthorEmail
+				cur.Time = known.Time
+				cur.Filename = known.Filename
+			} else {
+				commits[cur.Commit] = cur
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			cur.Content = line[1:]
+			lines = append(lines, *cur)
+			cur = nil
+			continue
+		}
+		key, value := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+		switch key {
+		case "author":
+			cur.AuthorName = value
+		case "author-mail":
+			cur.AuthorEmail = strings.Trim(value, "<>")
+		case "author-time":
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "unexpected author time in blame output")
+			}
+			cur.Time = time.Unix(ts, 0)
+		case "filename":
+			cur.Filename = value
+		}
+	}
+	return lines, nil
+}
+
+// ShowTag returns the details of tag and the commit it points to
+func (r *Repo) ShowTag(tag string) (*TagDetail, error) {
+	ref := "refs/tags/" + tag
+	commit, err := r.revParse(ref + "^{commit}")
+	if err != nil {
+		return nil, err
+	}
+	detail := &TagDetail{
+		Name:   tag,
+		Commit: commit,
+	}
+	objType, err := r.doGit("cat-file", "-t", ref)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(objType) != "tag" {
+		return detail, nil
+	}
+	detail.Annotated = true
+	out, err := r.doGit("cat-file", "tag", ref)
+	if err != nil {
+		return nil, err
+	}
+	// The tag object has header lines, e.g.
+	// tagger Name <email> 1500000000 +0200
+	// followed by an empty line and the message
+	parts := strings.SplitN(out, "\n\n", 2)
+	for _, line := range strings.Split(parts[0], "\n") {
+		if !strings.HasPrefix(line, "tagger ") {
+			continue
+		}
+		detail.Tagger, detail.TaggerEmail, detail.Date, err = parseIdent(strings.TrimPrefix(line, "tagger "))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(parts) == 2 {
+		detail.Message = strings.TrimSuffix(parts[1], "\n")
+	}
+	return detail, nil
+}
+
+// parseIdent parses an identity as stored in git objects:
+// "Name <email> <unix timestamp> <timezone>"
+func parseIdent(ident string) (string, string, time.Time, error) {
+	start := strings.Index(ident, "<")
+	end := strings.LastIndex(ident, ">")
+	if start < 0 || end < start {
+		return "", "", time.Time{}, errors.New("unexpected identity: " + ident)
+	}
+	name := strings.TrimSpace(ident[:start])
+	email := ident[start+1 : end]
+	fields := strings.Fields(ident[end+1:])
+	if len(fields) != 2 {
+		return "", "", time.Time{}, errors.New("unexpected identity: " + ident)
+	}
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", "", time.Time{}, errors.Wrap(err, "unexpected timestamp in identity")
+	}
+	date := time.Unix(ts, 0)
+	if zone, err := time.Parse("-0700", fields[1]); err == nil {
+		date = date.In(zone.Location())
+	}
+	return name, email, date, nil
+}
+
+// ShallowBoundary returns the commits at which the history of a shallow
+// clone is cut off. Their parents are missing from the repo. It returns
+// nothing when the repo is not shallow.
+func (r *Repo) ShallowBoundary() ([]string, error) {
+	p, err := r.gitPath("shallow")
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read shallow file")
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// LargeObjects returns the blobs reachable from any ref that are larger
+// than threshold bytes, largest first
+func (r *Repo) LargeObjects(threshold int64) ([]LargeObject, error) {
+	out, err := r.doGitStdout("rev-list", "--objects", "--all")
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	var shas bytes.Buffer
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 2 {
+			paths[parts[0]] = parts[1]
+		}
+		shas.WriteString(parts[0] + "\n")
+	}
+	out, err = r.doGitInput(&shas, "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	if err != nil {
+		return nil, err
+	}
+	var objects []LargeObject
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected output from git cat-file: "+line)
+		}
+		if size <= threshold {
+			continue
+		}
+		commits, err := r.doGit("log", "--all", "--format=%H", "--find-object="+fields[0])
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, LargeObject{
+			SHA:     fields[0],
+			Path:    paths[fields[0]],
+			Size:    size,
+			Commits: strings.Fields(commits),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Size > objects[j].Size })
+	return objects, nil
+}
+
+// VerifyConnectivity checks that all objects reachable from any ref are
+// present locally, without fetching missing objects from a promisor
+// remote. A *MissingObjectsError lists the objects that are missing.
+func (r *Repo) VerifyConnectivity() error {
+	out, err := r.doGit("rev-list", "--objects", "--all", "--missing=print")
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, line := range strings.Split(out, "\n") {
+		// missing objects are printed as ?<sha>
+		if strings.HasPrefix(line, "?") {
+			missing = append(missing, line[1:])
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingObjectsError{Objects: missing}
+	}
+	return nil
+}
+
+// WorktreeAdd creates a linked worktree in dir with ref checked out as a
+// detached HEAD, and returns a Repo for it that shares the object store
+func (r *Repo) WorktreeAdd(dir, ref string) (*Repo, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	_ = level.Debug(r.logger).Log("msg", "adding worktree", "dir", dir, "ref", ref)
+	if _, err := r.doGit("worktree", "add", "--detach", dir, ref); err != nil {
+		return nil, err
+	}
+	return &Repo{
+		logger:  log.With(r.logger, "worktree", dir),
+		URL:     r.URL,
+		Name:    r.Name,
+		WorkDir: filepath.Dir(dir),
+		RepoDir: dir,
+		opts:    r.opts,
+	}, nil
+}
+
+// WorktreeRemove removes the linked worktree in dir
+func (r *Repo) WorktreeRemove(dir string, options ...SetOptFunc) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	opts := r.callOpts(options)
+	_ = level.Debug(r.logger).Log("msg", "removing worktree", "dir", dir, "force", opts.ForceWorktreeRemove)
+	cmd := []string{"worktree", "remove"}
+	if opts.ForceWorktreeRemove {
+		cmd = append(cmd, "--force")
+	}
+	_, err := r.doGit(append(cmd, dir)...)
+	return err
+}
+
+// WorktreePrune removes the administrative files of worktrees whose
+// directory no longer exists
+func (r *Repo) WorktreePrune() error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	_ = level.Debug(r.logger).Log("msg", "pruning worktrees")
+	_, err := r.doGit("worktree", "prune")
+	return err
+}
+
+// ParallelCheckout creates a linked worktree in baseDir for each of refs,
+// so they can be used at the same time without cloning the repo again.
+// The returned Repos are in the same order as refs. Use CleanupWorktrees
+// to remove them again. When a worktree can't be created, the ones already
+// created for earlier refs are removed.
+func (r *Repo) ParallelCheckout(refs []string, baseDir string) ([]*Repo, error) {
+	var repos []*Repo
+	var dirs []string
+	for i, ref := range refs {
+		name := fmt.Sprintf("%d-%s", i, strings.Replace(ref, "/", "-", -1))
+		dir, err := filepath.Abs(filepath.Join(baseDir, name))
+		if err != nil {
+			r.removeWorktrees(dirs)
+			return nil, errors.Wrap(err, "failed to determine worktree dir")
+		}
+		wt, err := r.WorktreeAdd(dir, ref)
+		if err != nil {
+			r.removeWorktrees(dirs)
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+		repos = append(repos, wt)
+	}
+	r.worktreesMu.Lock()
+	r.worktrees = append(r.worktrees, dirs...)
+	r.worktreesMu.Unlock()
+	return repos, nil
+}
+
+// removeWorktrees removes the worktrees in dirs after a failed
+// ParallelCheckout. Those that can't be removed are left to
+// CleanupWorktrees.
+func (r *Repo) removeWorktrees(dirs []string) {
+	for _, dir := range dirs {
+		if err := r.WorktreeRemove(dir, SetForceWorktreeRemove()); err != nil {
+			_ = level.Debug(r.logger).Log("msg", "failed to remove worktree", "dir", dir, "err", err)
+			r.worktreesMu.Lock()
+			r.worktrees = append(r.worktrees, dir)
+			r.worktreesMu.Unlock()
+		}
+	}
+}
+
+// CleanupWorktrees removes all worktrees created by ParallelCheckout,
+// including any changes made in them
+func (r *Repo) CleanupWorktrees() error {
+	r.worktreesMu.Lock()
+	defer r.worktreesMu.Unlock()
+	for len(r.worktrees) > 0 {
+		dir := r.worktrees[0]
+		if err := r.WorktreeRemove(dir, SetForceWorktreeRemove()); err != nil {
+			return err
+		}
+		r.worktrees = r.worktrees[1:]
+	}
+	return nil
+}
+
+// HasLFS checks whether the repo uses Git LFS, either because files are
+// tracked by LFS in .gitattributes or LFS objects have been fetched
+func (r *Repo) HasLFS() (bool, error) {
+	if r.gitPathExists("lfs") {
+		return true, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.RepoDir, ".gitattributes"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to read .gitattributes")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, attr := range strings.Fields(line) {
+			if attr == "filter=lfs" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// CommitAuthor returns the email of the author of commit
+func (r *Repo) CommitAuthor(commit string) (string, error) {
+	out, err := r.doGit("log", "--format=%ae", commit+"^!")
+	if err != nil { return "", errors.Wrap(err, "error retrieving author for commit " + commit) }
+	return strings.TrimSpace(out), nil
+}
+
+// CommitAuthorName returns the name of the author of commit
+func (r *Repo) CommitAuthorName(commit string) (string, error) {
+	out, err := r.doGit("log", "--format=%an", commit+"^!")
+	if err != nil {
+		return "", errors.Wrap(err, "error retrieving author for commit "+commit)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// CommitAuthorIdentity returns the name, email and date of the author of
+// commit at once
+func (r *Repo) CommitAuthorIdentity(commit string) (*Identity, error) {
+	out, err := r.doGit("log", "--format=%an%x00%ae%x00%aI", commit+"^!")
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving author for commit "+commit)
+	}
+	fields := strings.Split(strings.TrimSpace(out), "\x00")
+	if len(fields) != 3 {
+		return nil, errors.New("unexpected output from git log: " + out)
+	}
+	date, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "unexpected author date")
+	}
+	return &Identity{Name: fields[0], Email: fields[1], Date: date}, nil
+}
+
+// CommitCommitter returns who committed a commit, which differs from the
+// author for e.g. rebased or cherry-picked commits
+func (r *Repo) CommitCommitter(commit string) (name, email string, date time.Time, err error) {
+	out, err := r.doGit("show", "-s", "--format=%cn%x00%ce%x00%cI", commit)
+	if err != nil {
+		return "", "", time.Time{}, errors.Wrap(err, "error retrieving committer for commit "+commit)
+	}
+	fields := strings.Split(strings.TrimSpace(out), "\x00")
+	if len(fields) != 3 {
+		return "", "", time.Time{}, errors.New("unexpected output from git show: " + out)
+	}
+	date, err = time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return "", "", time.Time{}, errors.Wrap(err, "unexpected committer date")
+	}
+	return fields[0], fields[1], date, nil
+}
+
+func (r *Repo) doGit(args ...string) (string, error) {
+	return r.doGitEnvCtx(context.Background(), nil, args...)
+}
+
+func (r *Repo) doGitCtx(ctx context.Context, args ...string) (string, error) {
+	return r.doGitEnvCtx(ctx, nil, args...)
+}
+
+// doGitEnv runs git with env added to the environment
+func (r *Repo) doGitEnv(env []string, args ...string) (string, error) {
+	return r.doGitEnvCtx(context.Background(), env, args...)
+}
+
+func (r *Repo) doGitEnvCtx(ctx context.Context, env []string, args ...string) (string, error) {
+	r.cmdMu.Lock()
+	defer r.cmdMu.Unlock()
+	cmd := r.gitCmd(ctx, r.RepoDir, args...)
+	if env != nil {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	out, err := combinedOutput(ctx, cmd)
+	command := r.redact(strings.Join(args, " "))
+	if err != nil && ctx.Err() != nil {
+		return "", errors.Wrap(ctx.Err(), "command 'git "+command+"' on repo "+r.Name+" aborted")
+	}
+	if err != nil || !cmd.ProcessState.Success() {
+		return "", errors.Wrap(err, "failed to run command 'git "+command+"' on repo "+r.Name+": "+r.redact(string(out)))
+	}
+	return string(out), nil
+}
+
+// doGitStdout runs git and returns only its stdout, unmodified, for output
+// that may be binary
+func (r *Repo) doGitStdout(args ...string) ([]byte, error) {
+	return r.doGitInput(nil, args...)
+}
+
+// doGitInput runs git with stdin as its input and returns its stdout
+func (r *Repo) doGitInput(stdin io.Reader, args ...string) ([]byte, error) {
+	r.cmdMu.Lock()
+	defer r.cmdMu.Unlock()
+	cmd := r.gitCmd(context.Background(), r.RepoDir, args...)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr string
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = string(exitErr.Stderr)
+		}
+		command := r.redact(strings.Join(args, " "))
+		return nil, errors.Wrap(err, "failed to run command 'git "+command+"' on repo "+r.Name+": "+r.redact(stderr))
+	}
+	return out, nil
+}
+
+// Lock locks the repo for a sequence of operations, e.g. Pull, Add and
+// Commit, that should not be interleaved with operations from other
+// goroutines that Lock the repo too. Single git commands never interleave,
+// whether the repo is locked or not.
+func (r *Repo) Lock() {
+	r.opMu.Lock()
+}
+
+// Unlock unlocks the repo after Lock
+func (r *Repo) Unlock() {
+	r.opMu.Unlock()
+}
+
+// writable returns ErrReadOnly for read-only repos. All methods that
+// change the repo call it before doing anything.
+func (r *Repo) writable() error {
+	if r.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// upstream returns the upstream of the current branch, e.g. origin/master
+func (r *Repo) upstream() (string, error) {
+	out, err := r.doGit("rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+	if err != nil {
+		return "", errors.Wrap(ErrNoUpstream, err.Error())
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// aheadBehind returns the number of commits in local that are not in
+// upstream and vice versa
+func (r *Repo) aheadBehind(local, upstream string) (int, int, error) {
+	out, err := r.doGit("rev-list", "--left-right", "--count", local+"..."+upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return 0, 0, errors.New("unexpected output from git rev-list: " + out)
+	}
+	ahead, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "unexpected output from git rev-list")
+	}
+	behind, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "unexpected output from git rev-list")
+	}
+	return ahead, behind, nil
+}
+
+// Status returns the entries of git status, including all untracked files
+func (r *Repo) Status() ([]*StatusEntry, error) {
+	out, err := r.doGit("status", "--porcelain=v1", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	// entries are "XY path\0", renames and copies are followed by "origpath\0"
+	var entries []*StatusEntry
+	fields := strings.Split(out, "\x00")
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if len(field) < 4 {
+			continue
+		}
+		entry := &StatusEntry{Index: field[0], WorkTree: field[1], Path: field[3:]}
+		if (entry.Index == 'R' || entry.Index == 'C') && i+1 < len(fields) {
+			i++
+			entry.OrigPath = fields[i]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// hasConflicts checks whether there are unmerged files in the index
+func (r *Repo) hasConflicts() (bool, error) {
+	files, err := r.ConflictedFiles()
+	return len(files) > 0, err
+}
+
+// hasLocalChanges checks whether tracked files have staged or unstaged
+// changes. Untracked files are ignored.
+func (r *Repo) hasLocalChanges() (bool, error) {
+	entries, err := r.Status()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Index != '?' {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// workTreeClean checks whether the working tree and index have no changes
+// compared to HEAD, including untracked files
+func (r *Repo) workTreeClean() (bool, error) {
+	out, err := r.doGit("status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "", nil
+}
+
+// hasStagedChanges checks whether the index differs from HEAD. Everything
+// in the index counts as staged when there is no HEAD commit yet.
+func (r *Repo) hasStagedChanges() (bool, error) {
+	if _, err := r.revParse("HEAD"); err != nil {
+		return true, nil
+	}
+	_, err := r.doGit("diff-index", "--cached", "--quiet", "HEAD", "--")
+	if err == nil {
+		return false, nil
+	}
+	if exitCode(err) == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// isBranch checks whether name is a local branch or a branch on origin
+func (r *Repo) isBranch(name string) bool {
+	for _, ref := range []string{"refs/heads/" + name, "refs/remotes/origin/" + name} {
+		if _, err := r.doGit("show-ref", "--verify", "--quiet", ref); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isDetached checks whether HEAD is detached, i.e. not on a branch
+func (r *Repo) isDetached() bool {
+	_, err := r.doGit("symbolic-ref", "--quiet", "HEAD")
+	return exitCode(err) == 1
+}
+
+// checkoutRef checks out ref, as a branch when it is one and as a
+// detached HEAD otherwise
+func (r *Repo) checkoutRef(ref string) error {
+	if r.isBranch(ref) {
+		return r.Checkout(ref)
+	}
+	return r.checkoutDetached(ref)
+}
+
+// checkoutDetached checks out the tag or commit ref as a detached HEAD,
+// unless it's already checked out
+func (r *Repo) checkoutDetached(ref string) error {
+	commit, err := r.revParse(ref + "^{commit}")
+	if err != nil {
+		return err
+	}
+	if head, err := r.CurrentCommit(); err == nil && head == commit && r.isDetached() {
+		return nil
+	}
+	return r.Checkout(commit)
+}
+
+// exists checks whether the repo has been cloned already
+func (r *Repo) exists() bool {
+	_, err := os.Stat(path.Join(r.RepoDir, ".git"))
+	return !os.IsNotExist(err)
+}
+
+// revParse resolves a revision to its SHA
+func (r *Repo) revParse(rev string) (string, error) {
+	out, err := r.doGit("rev-parse", "--verify", "--quiet", rev)
+	if err != nil {
+		return "", errors.Wrap(err, "unknown revision "+rev)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// isAncestor checks whether commit a is an ancestor of commit b
+func (r *Repo) isAncestor(a, b string) (bool, error) {
+	_, err := r.doGit("merge-base", "--is-ancestor", a, b)
+	if err == nil {
+		return true, nil
+	}
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// inProgress returns the operation (rebase, merge, cherry-pick or revert)
+// that is in progress in the repo, or an empty string if there is none
+func (r *Repo) inProgress() string {
+	switch {
+	case r.gitPathExists("rebase-merge") || r.gitPathExists("rebase-apply"):
+		return "rebase"
+	case r.gitPathExists("MERGE_HEAD"):
+		return "merge"
+	case r.gitPathExists("CHERRY_PICK_HEAD"):
+		return "cherry-pick"
+	case r.gitPathExists("REVERT_HEAD"):
+		return "revert"
+	}
+	return ""
+}
+
+// gitPathExists checks whether a path inside the .git dir exists
+func (r *Repo) gitPathExists(name string) bool {
+	p, err := r.gitPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// gitPath returns the absolute path of a path inside the .git dir
+func (r *Repo) gitPath(name string) (string, error) {
+	out, err := r.doGit("rev-parse", "--git-path", name)
+	if err != nil {
+		return "", err
+	}
+	p := strings.TrimSpace(out)
+	if !path.IsAbs(p) {
+		p = path.Join(r.RepoDir, p)
+	}
+	return p, nil
+}
+
+// gitCmd prepares a git command to be run in dir, which is killed when
+// ctx is done
+func (r *Repo) gitCmd(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	args = append(r.opts.configArgs(), args...)
+	bin := "git"
+	if r.opts.GitBinary != "" {
+		bin = r.opts.GitBinary
+	}
+	if r.opts.UseDashC {
+		args = append([]string{"-C", dir}, args...)
+	}
+	if r.opts.ArgTransform != nil {
+		args = r.opts.ArgTransform(args)
+	}
+	cmd := exec.CommandContext(ctx, bin, args...)
+	if !r.opts.UseDashC {
+		cmd.Dir = dir
+	}
+	if env := r.opts.env(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// redact removes the password used for authentication from s
+func (r *Repo) redact(s string) string {
+	if r.opts.AuthPassword == "" {
+		return s
+	}
+	return strings.Replace(s, r.opts.AuthPassword, "[redacted]", -1)
+}
+
+// callOpts applies the options for a single call on top of the repo's options
+func (r *Repo) callOpts(optSetters []SetOptFunc) *GitOpts {
+	opts := r.opts
+	for _, optSetter := range optSetters {
+		optSetter(&opts)
+	}
+	return &opts
+}
+
+// combinedOutput runs cmd and returns its combined stdout and stderr. For
+// a cancellable ctx the output goes to a temp file instead of a pipe, as
+// processes started by git (e.g. ssh) would otherwise keep the pipe open,
+// blocking until they finish even after git itself has been killed.
+func combinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	if ctx.Done() == nil {
+		return cmd.CombinedOutput()
+	}
+	f, err := ioutil.TempFile("", "gogit")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create file for git output")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	cmd.Stdout = f
+	cmd.Stderr = f
+	runErr := cmd.Run()
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read git output")
+	}
+	return out, runErr
+}
+
+// exitCode returns the exit code of a failed git command, or -1 if err
+// didn't come from a command that ran
+func exitCode(err error) int {
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// configArgs returns the -c arguments to pass to every git command
+func (o *GitOpts) configArgs() []string {
+	var args []string
+	if o.HTTPPostBuffer > 0 {
+		args = append(args, "-c", "http.postBuffer="+strconv.Itoa(o.HTTPPostBuffer))
+	}
+	if o.LowSpeedLimit > 0 {
+		args = append(args, "-c", "http.lowSpeedLimit="+strconv.Itoa(o.LowSpeedLimit),
+			"-c", "http.lowSpeedTime="+strconv.Itoa(o.LowSpeedTime))
+	}
+	if o.AuthPassword != "" {
+		// replace any configured credential helpers by one that answers
+		// with the credentials from the environment
+		args = append(args, "-c", "credential.helper=",
+			"-c", `credential.helper=!f() { test "$1" = get && echo "username=$GOGIT_AUTH_USERNAME" && echo "password=$GOGIT_AUTH_PASSWORD"; }; f`)
+	}
+	return args
+}
+
+// env returns the environment variables to set for every git command
+func (o *GitOpts) env() []string {
+	env := append([]string(nil), o.Env...)
+	if o.AuthPassword != "" {
+		// the credential helper reads these, see configArgs
+		env = append(env,
+			"GOGIT_AUTH_USERNAME="+o.AuthUsername,
+			"GOGIT_AUTH_PASSWORD="+o.AuthPassword)
+	}
+	if ssh := o.sshCommand(); ssh != "" {
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+	return env
+}
+
+// sshCommand returns the command git should use for SSH remotes, or an
+// empty string to use git's default
+func (o *GitOpts) sshCommand() string {
+	var args []string
+	if o.SSHKey != "" {
+		args = append(args, "-i", shellQuote(o.SSHKey), "-o", "IdentitiesOnly=yes")
+	}
+	if o.SSHKnownHosts != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+o.SSHKnownHosts))
+	}
+	if o.StrictHostKeySet {
+		if o.StrictHostKeyCheck {
+			args = append(args, "-o", "StrictHostKeyChecking=yes")
+		} else {
+			args = append(args, "-o", "StrictHostKeyChecking=no")
+		}
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return "ssh " + strings.Join(args, " ")
+}
+
+// shellQuote quotes s for use in GIT_SSH_COMMAND, which is run by a shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// cleanupArgs returns the --cleanup argument for the mode set with
+// SetMessageCleanup
+func (o *GitOpts) cleanupArgs() ([]string, error) {
+	switch o.MessageCleanup {
+	case "":
+		return nil, nil
+	case "strip", "whitespace", "verbatim", "scissors":
+		return []string{"--cleanup=" + o.MessageCleanup}, nil
+	}
+	return nil, errors.New("invalid message cleanup mode '" + o.MessageCleanup + "'")
+}
+
+// signingFormatArgs returns the -c argument for the signature format set
+// with SetSigningFormat
+func (o *GitOpts) signingFormatArgs() []string {
+	if o.SigningFormat == "" {
+		return nil
+	}
+	return []string{"-c", "gpg.format=" + o.SigningFormat}
+}
+
+// mergeDriverArgs returns the -c arguments that configure the merge
+// drivers set with SetMergeDriver
+func (o *GitOpts) mergeDriverArgs() ([]string, error) {
+	names := make([]string, 0, len(o.MergeDrivers))
+	for name := range o.MergeDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		driver := o.MergeDrivers[name]
+		if name == "" || strings.ContainsAny(name, " \t=") {
+			return nil, errors.New("invalid merge driver name '" + name + "'")
+		}
+		for _, placeholder := range []string{"%O", "%A", "%B"} {
+			if !strings.Contains(driver, placeholder) {
+				return nil, errors.New("merge driver " + name + " doesn't use " + placeholder)
+			}
+		}
+		args = append(args, "-c", "merge."+name+".driver="+driver)
+	}
+	return args, nil
+}
+
+// jobsArgs returns the --jobs argument, if set
+func (o *GitOpts) jobsArgs() ([]string, error) {
+	if !o.JobsSet {
+		return nil, nil
+	}
+	if o.Jobs < 1 {
+		return nil, errors.New("number of jobs must be at least 1")
+	}
+	return []string{"--jobs", strconv.Itoa(o.Jobs)}, nil
+}
+
+// renameArgs returns the diff arguments for rename and copy detection
+func (o *GitOpts) renameArgs() []string {
+	args := []string{"-M"}
+	if o.FindRenames > 0 {
+		args = []string{fmt.Sprintf("--find-renames=%d%%", o.FindRenames)}
+	}
+	if o.FindCopiesHarder {
+		args = append(args, "--find-copies-harder")
+	} else if o.FindCopies {
+		args = append(args, "--find-copies")
+	}
+	return args
 }
 
 func getOpts(optSetters []SetOptFunc) (*GitOpts) {
@@ -0,0 +1,2675 @@
+package gogit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests with a git config of their own, so they don't
+// depend on the config of the user running them
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "gogit-home")
+	if err != nil {
+		panic(err)
+	}
+	config := "[user]\n\tname = Test User\n\temail = test@example.com\n" +
+		"[init]\n\tdefaultBranch = master\n" +
+		"[protocol \"file\"]\n\tallow = always\n"
+	if err := ioutil.WriteFile(filepath.Join(home, ".gitconfig"), []byte(config), 0644); err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("XDG_CONFIG_HOME", home)
+	os.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// git runs git in dir and fails the test when it fails
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitAt runs git in dir like git, with both the author and committer
+// date set to date
+func gitAt(t *testing.T, dir, date string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeFile writes content to name in dir, creating parent dirs as needed
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commitFile writes content to name in dir and commits it with msg
+func commitFile(t *testing.T, dir, name, content, msg string) string {
+	t.Helper()
+	writeFile(t, dir, name, content)
+	git(t, dir, "add", "--", name)
+	git(t, dir, "commit", "-q", "-m", msg)
+	return git(t, dir, "rev-parse", "HEAD")
+}
+
+// diverge commits base to name on master, then commits theirs on a new
+// branch other and ours on master, leaving master checked out
+func diverge(t *testing.T, dir, name, base, ours, theirs string) {
+	t.Helper()
+	commitFile(t, dir, name, base, "base of "+name)
+	git(t, dir, "checkout", "-q", "-b", "other")
+	commitFile(t, dir, name, theirs, "their "+name)
+	git(t, dir, "checkout", "-q", "master")
+	commitFile(t, dir, name, ours, "our "+name)
+}
+
+// mergeConflict merges other into master, expecting it to conflict
+func mergeConflict(t *testing.T, dir string, config ...string) {
+	t.Helper()
+	args := append(config, "merge", "-q", "other")
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("expected the merge to conflict: %s", out)
+	}
+}
+
+// newRemote creates a bare remote with a single commit on master. It
+// returns the remote and a clone of it that can be used to push changes.
+func newRemote(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+	git(t, dir, "init", "-q", "--bare", remote)
+	seed := filepath.Join(dir, "seed")
+	git(t, dir, "clone", "-q", remote, seed)
+	commitFile(t, seed, "README", "hello\n", "initial commit")
+	git(t, seed, "push", "-q", "origin", "master")
+	return remote, seed
+}
+
+// newRepo clones remote into a new temp dir with New
+func newRepo(t *testing.T, remote string, options ...SetOptFunc) *Repo {
+	t.Helper()
+	repo, err := New(remote, "master", t.TempDir(), log.NewNopLogger(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// recordArgs records the arguments of every git command that is run
+func recordArgs(calls *[][]string) SetOptFunc {
+	return SetArgTransform(func(args []string) []string {
+		*calls = append(*calls, append([]string(nil), args...))
+		return args
+	})
+}
+
+// findCall returns the first recorded call that runs the git command cmd
+func findCall(calls [][]string, cmd string) []string {
+	for _, call := range calls {
+		for _, arg := range call {
+			if arg == cmd {
+				return call
+			}
+		}
+	}
+	return nil
+}
+
+// noIdentity makes git in dir fail to commit for the rest of the test,
+// as there is no identity configured and git won't guess one
+func noIdentity(t *testing.T, dir string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	git(t, dir, "config", "user.useConfigOnly", "true")
+}
+
+// chdir changes to dir for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+}
+
+func TestUseDashC(t *testing.T) {
+	remote, seed := newRemote(t)
+	commitFile(t, seed, "file", "content\n", "second commit")
+	git(t, seed, "push", "-q")
+	chdir(t, t.TempDir())
+
+	var logs []string
+	for _, workDir := range []string{"plain", "dashc"} {
+		if err := os.Mkdir(workDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var options []SetOptFunc
+		if workDir == "dashc" {
+			options = append(options, SetUseDashC())
+		}
+		repo, err := New(remote, "master", workDir, log.NewNopLogger(), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo.RepoDir != filepath.Join(workDir, "remote") {
+			t.Fatalf("RepoDir is %q", repo.RepoDir)
+		}
+		out, err := repo.doGit("log", "--format=%H %s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, out)
+	}
+	if logs[0] != logs[1] {
+		t.Errorf("log without -C:\n%s\nlog with -C:\n%s", logs[0], logs[1])
+	}
+	if strings.Count(logs[0], "\n") != 2 {
+		t.Errorf("expected two commits, got:\n%s", logs[0])
+	}
+}
+
+func TestReleaseDiff(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitFile(t, dir, "modified", "one\ntwo\n", "add modified")
+	commitFile(t, dir, "renamed", "a\nb\nc\nd\ne\n", "add renamed")
+	git(t, dir, "tag", "v1")
+
+	writeFile(t, dir, "added", "x\ny\nz\n")
+	writeFile(t, dir, "modified", "one\nthree\n")
+	git(t, dir, "mv", "renamed", "moved")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "changes")
+
+	report, err := repo.ReleaseDiff("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ReleaseDiffFile{
+		"added":    {DiffStat: DiffStat{Stat: StatNew, Filename: "added"}, Added: 3},
+		"modified": {DiffStat: DiffStat{Stat: StatModified, Filename: "modified"}, Added: 1, Deleted: 1},
+		"moved":    {DiffStat: DiffStat{Stat: StatRenamed, Filename: "moved", OldFilename: "renamed"}},
+	}
+	if len(report.Files) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(report.Files))
+	}
+	for _, f := range report.Files {
+		if w, ok := want[f.Filename]; !ok || *f != w {
+			t.Errorf("unexpected file %+v", *f)
+		}
+	}
+	if report.Tag != "v1" || report.Added != 4 || report.Deleted != 1 {
+		t.Errorf("unexpected totals: tag %s, +%d -%d", report.Tag, report.Added, report.Deleted)
+	}
+}
+
+func TestPushStatus(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote)
+
+	check := func(state string, action PushAction, ahead, behind int) {
+		t.Helper()
+		ps, err := repo.PushStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ps.Action != action || ps.Ahead != ahead || ps.Behind != behind {
+			t.Errorf("%s: got %+v", state, *ps)
+		}
+		if ps.Branch != "master" || ps.Upstream != "origin/master" {
+			t.Errorf("%s: unexpected branch %s or upstream %s", state, ps.Branch, ps.Upstream)
+		}
+	}
+	check("synced", PushNone, 0, 0)
+
+	commitFile(t, repo.RepoDir, "local", "local\n", "local commit")
+	check("ahead", PushNormal, 1, 0)
+
+	git(t, repo.RepoDir, "reset", "-q", "--hard", "HEAD^")
+	commitFile(t, seed, "upstream", "upstream\n", "upstream commit")
+	git(t, seed, "push", "-q")
+	check("behind", PushPull, 0, 1)
+
+	commitFile(t, repo.RepoDir, "local", "local\n", "local commit")
+	check("diverged", PushForce, 1, 1)
+}
+
+func TestFileVersions(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	var commits []string
+	for _, content := range []string{"v1\n", "v2\n", "v3\n"} {
+		commits = append(commits, commitFile(t, repo.RepoDir, "file", content, "edit file"))
+	}
+
+	versions, err := repo.FileVersions("file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	for i, v := range versions {
+		// newest first
+		want := len(commits) - 1 - i
+		if v.Commit != commits[want] || v.Content != "v"+strconv.Itoa(want+1)+"\n" {
+			t.Errorf("version %d: got commit %s with %q", i, v.Commit, v.Content)
+		}
+		if v.Date.IsZero() {
+			t.Errorf("version %d has no date", i)
+		}
+	}
+
+	versions, err = repo.FileVersions("file", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("expected 2 versions with max 2, got %d", len(versions))
+	}
+}
+
+func TestAbortPullOnConflict(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote)
+	local := commitFile(t, repo.RepoDir, "README", "local\n", "local change")
+	commitFile(t, seed, "README", "upstream\n", "upstream change")
+	git(t, seed, "push", "-q")
+
+	err := repo.Pull(SetOptRebase(), SetAbortPullOnConflict())
+	if errors.Cause(err) != ErrPullConflict {
+		t.Fatalf("expected ErrPullConflict, got %v", err)
+	}
+	if op := repo.inProgress(); op != "" {
+		t.Errorf("%s still in progress", op)
+	}
+	if head := git(t, repo.RepoDir, "rev-parse", "HEAD"); head != local {
+		t.Errorf("HEAD moved to %s", head)
+	}
+	if status := git(t, repo.RepoDir, "status", "--porcelain"); status != "" {
+		t.Errorf("working tree not restored:\n%s", status)
+	}
+}
+
+func TestRemoteRefs(t *testing.T) {
+	remote, seed := newRemote(t)
+	head := git(t, seed, "rev-parse", "HEAD")
+	git(t, seed, "tag", "light")
+	git(t, seed, "tag", "-a", "-m", "annotated", "annotated")
+	git(t, seed, "push", "-q", "--tags")
+	repo := newRepo(t, remote)
+
+	refs, err := repo.RemoteRefs("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"master": head, "light": head, "annotated": head}
+	if len(refs) != len(want) {
+		t.Errorf("unexpected refs %v", refs)
+	}
+	for name, sha := range want {
+		if refs[name] != sha {
+			t.Errorf("%s: expected %s, got %s", name, sha, refs[name])
+		}
+	}
+}
+
+func TestNoGPGSign(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	git(t, repo.RepoDir, "config", "commit.gpgsign", "true")
+	// signing can't succeed, so only an unsigned commit gets through
+	git(t, repo.RepoDir, "config", "gpg.program", "false")
+
+	writeFile(t, repo.RepoDir, "file", "content\n")
+	if err := repo.Add("file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Commit("signed"); err == nil {
+		t.Fatal("expected signing to fail without SetNoGPGSign")
+	}
+	sha, err := repo.Commit("unsigned", SetNoGPGSign())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := git(t, repo.RepoDir, "rev-parse", "HEAD"); head != sha {
+		t.Errorf("expected HEAD %s, got %s", sha, head)
+	}
+}
+
+func TestFastForwardRef(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	base := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "branch", "behind")
+	git(t, dir, "branch", "diverged")
+	tip := commitFile(t, dir, "file", "master\n", "master commit")
+
+	if err := repo.FastForwardRef("behind", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if sha := git(t, dir, "rev-parse", "behind"); sha != tip {
+		t.Errorf("expected behind at %s, got %s", tip, sha)
+	}
+
+	git(t, dir, "checkout", "-q", "diverged")
+	diverged := commitFile(t, dir, "other", "diverged\n", "diverged commit")
+	git(t, dir, "checkout", "-q", "master")
+	if err := repo.FastForwardRef("diverged", "master"); errors.Cause(err) != ErrNotFastForward {
+		t.Fatalf("expected ErrNotFastForward, got %v", err)
+	}
+	if sha := git(t, dir, "rev-parse", "diverged"); sha != diverged {
+		t.Errorf("diverged moved from %s to %s", diverged, sha)
+	}
+	if sha := git(t, dir, "rev-parse", "HEAD"); sha == base {
+		t.Error("master moved")
+	}
+}
+
+func TestMatchesCommit(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	first := git(t, repo.RepoDir, "rev-parse", "HEAD")
+	second := commitFile(t, repo.RepoDir, "file", "content\n", "second commit")
+
+	if ok, err := repo.MatchesCommit(second); err != nil || !ok {
+		t.Errorf("clean: expected a match, got %v, %v", ok, err)
+	}
+	if ok, err := repo.MatchesCommit(first); err != nil || ok {
+		t.Errorf("other commit: expected no match, got %v, %v", ok, err)
+	}
+	writeFile(t, repo.RepoDir, "file", "changed\n")
+	if ok, err := repo.MatchesCommit(second); err != nil || ok {
+		t.Errorf("dirty: expected no match, got %v, %v", ok, err)
+	}
+}
+
+func TestCloneArgs(t *testing.T) {
+	var calls [][]string
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote, recordArgs(&calls), SetCloneArgs("--config", "gogit.test=passed"))
+	call := findCall(calls, "clone")
+	target, err := filepath.Rel(repo.WorkDir, repo.RepoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the extra args come last, right before the URL and the target
+	expected := []string{"--config", "gogit.test=passed", remote, target}
+	if len(call) < len(expected) || strings.Join(call[len(call)-len(expected):], " ") != strings.Join(expected, " ") {
+		t.Errorf("expected clone to end with %v, got %v", expected, call)
+	}
+	if value := git(t, repo.RepoDir, "config", "gogit.test"); value != "passed" {
+		t.Errorf("expected the clone to set gogit.test, got %q", value)
+	}
+}
+
+func TestConflictHunks(t *testing.T) {
+	for _, style := range []string{"merge", "diff3"} {
+		t.Run(style, func(t *testing.T) {
+			remote, _ := newRemote(t)
+			repo := newRepo(t, remote)
+			// the conflicts need to be apart, or git joins them
+			middle := strings.Repeat("same\n", 10)
+			diverge(t, repo.RepoDir, "file",
+				"a\n"+middle+"e\n", "A\n"+middle+"E\n", "1\n"+middle+"5\n")
+			mergeConflict(t, repo.RepoDir, "-c", "merge.conflictStyle="+style)
+
+			hunks, err := repo.ConflictHunks("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []ConflictHunk{
+				{OursLabel: "HEAD", Ours: "A\n", TheirsLabel: "other", Theirs: "1\n"},
+				{OursLabel: "HEAD", Ours: "E\n", TheirsLabel: "other", Theirs: "5\n"},
+			}
+			if style == "diff3" {
+				want[0].Base, want[1].Base = "a\n", "e\n"
+			}
+			if len(hunks) != len(want) {
+				t.Fatalf("expected %d hunks, got %+v", len(want), hunks)
+			}
+			for i, h := range hunks {
+				if h.StartLine == 0 || h.EndLine <= h.StartLine {
+					t.Errorf("hunk %d: bad lines %d-%d", i, h.StartLine, h.EndLine)
+				}
+				if style == "diff3" && h.BaseLabel == "" {
+					t.Errorf("hunk %d: no base label", i)
+				}
+				h.StartLine, h.EndLine, h.BaseLabel = 0, 0, ""
+				if h != want[i] {
+					t.Errorf("hunk %d: got %+v", i, h)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchAll(t *testing.T) {
+	remote, seed := newRemote(t)
+	other, otherSeed := newRemote(t)
+	repo := newRepo(t, remote)
+	if err := repo.AddRemote("other", other); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"origin/master": commitFile(t, seed, "file", "origin\n", "origin commit"),
+		"other/master":  commitFile(t, otherSeed, "file", "other\n", "other commit"),
+	}
+	git(t, seed, "push", "-q")
+	git(t, otherSeed, "push", "-q")
+
+	if err := repo.FetchAll(false); err != nil {
+		t.Fatal(err)
+	}
+	for ref, sha := range want {
+		if got := git(t, repo.RepoDir, "rev-parse", ref); got != sha {
+			t.Errorf("%s: expected %s, got %s", ref, sha, got)
+		}
+	}
+}
+
+func TestNoCheckout(t *testing.T) {
+	remote, seed := newRemote(t)
+	head := git(t, seed, "rev-parse", "HEAD")
+	repo := newRepo(t, remote, SetNoCheckout())
+
+	entries, err := ioutil.ReadDir(repo.RepoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != ".git" {
+			t.Errorf("unexpected %s in working tree", entry.Name())
+		}
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "origin/master"); sha != head {
+		t.Errorf("expected origin/master at %s, got %s", head, sha)
+	}
+}
+
+func TestBranchStatus(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	for _, branch := range []string{"ahead", "behind", "gone"} {
+		git(t, dir, "branch", branch)
+		git(t, dir, "push", "-q", "-u", "origin", branch)
+	}
+	git(t, dir, "checkout", "-q", "ahead")
+	commitFile(t, dir, "file", "ahead\n", "ahead commit")
+	git(t, dir, "checkout", "-q", "behind")
+	commitFile(t, dir, "file", "behind\n", "behind commit")
+	git(t, dir, "push", "-q")
+	git(t, dir, "reset", "-q", "--hard", "HEAD^")
+	git(t, dir, "checkout", "-q", "master")
+	git(t, dir, "push", "-q", "origin", "--delete", "gone")
+	git(t, dir, "branch", "local")
+
+	tracks, err := repo.BranchStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]BranchTrack{
+		"ahead":  {Branch: "ahead", Upstream: "origin/ahead", Ahead: 1},
+		"behind": {Branch: "behind", Upstream: "origin/behind", Behind: 1},
+		"gone":   {Branch: "gone", Upstream: "origin/gone", Gone: true},
+		"master": {Branch: "master", Upstream: "origin/master"},
+		"local":  {Branch: "local"},
+	}
+	if len(tracks) != len(want) {
+		t.Errorf("expected %d branches, got %+v", len(want), tracks)
+	}
+	for _, track := range tracks {
+		if track != want[track.Branch] {
+			t.Errorf("got %+v", track)
+		}
+	}
+}
+
+func TestExportRef(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	writeFile(t, dir, "sub/script.sh", "#!/bin/sh\necho hi\n")
+	if err := os.Chmod(filepath.Join(dir, "sub/script.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "add", "sub/script.sh")
+	commitFile(t, dir, "sub/data", "data\n", "add script")
+	git(t, dir, "tag", "-a", "-m", "release", "v1")
+	commitFile(t, dir, "sub/data", "changed after the tag\n", "change data")
+
+	export := filepath.Join(t.TempDir(), "export")
+	if err := repo.ExportRef("v1", export); err != nil {
+		t.Fatal(err)
+	}
+	checkout := filepath.Join(t.TempDir(), "checkout")
+	git(t, dir, "clone", "-q", "--branch", "v1", dir, checkout)
+
+	got, want := treeFiles(t, export), treeFiles(t, checkout)
+	if !strings.HasPrefix(want["sub/script.sh"], "-rwx") {
+		t.Fatalf("script not executable in checkout: %q", want["sub/script.sh"])
+	}
+	if len(got) != len(want) {
+		t.Errorf("exported %v, checked out %v", got, want)
+	}
+	for name, file := range want {
+		if got[name] != file {
+			t.Errorf("%s: exported %q, checked out %q", name, got[name], file)
+		}
+	}
+	if status := git(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("working tree changed:\n%s", status)
+	}
+}
+
+// treeFiles returns the mode and content of each file below dir, except
+// those in .git
+func treeFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[rel] = info.Mode().String() + " " + string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSignPush(t *testing.T) {
+	remote, _ := newRemote(t)
+	// the remote has to accept push certificates, or git refuses to sign
+	git(t, remote, "config", "receive.certNonceSeed", "seed")
+	var calls [][]string
+	repo := newRepo(t, remote, recordArgs(&calls))
+	git(t, repo.RepoDir, "config", "user.signingkey", "no-such-key")
+	git(t, repo.RepoDir, "config", "gpg.program", "false")
+	commitFile(t, repo.RepoDir, "file", "content\n", "commit")
+
+	err := repo.Push(SetSignPush())
+	if errors.Cause(err) != ErrPushSignature {
+		t.Errorf("expected ErrPushSignature, got %v", err)
+	}
+	push := findCall(calls, "push")
+	if push == nil || push[len(push)-1] != "--signed" {
+		t.Errorf("expected push --signed, got %v", push)
+	}
+}
+
+func TestSignPushWithKey(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+	home := t.TempDir()
+	t.Setenv("GNUPGHOME", home)
+	cmd := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "Test User <test@example.com>", "default", "default", "never")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("failed to generate a gpg key: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	})
+
+	remote, _ := newRemote(t)
+	git(t, remote, "config", "receive.certNonceSeed", "seed")
+	// the hook rejects pushes without a certificate
+	hook := filepath.Join(remote, "hooks", "pre-receive")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\ntest -n \"$GIT_PUSH_CERT\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var calls [][]string
+	repo := newRepo(t, remote, recordArgs(&calls))
+	git(t, repo.RepoDir, "config", "user.signingkey", "test@example.com")
+	head := commitFile(t, repo.RepoDir, "file", "content\n", "commit")
+
+	if err := repo.Push(SetSignPush()); err != nil {
+		t.Fatal(err)
+	}
+	if push := findCall(calls, "push"); push == nil || push[len(push)-1] != "--signed" {
+		t.Errorf("expected push --signed, got %v", push)
+	}
+	if ref := git(t, remote, "rev-parse", "master"); ref != head {
+		t.Errorf("expected remote master at %s, got %s", head, ref)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	var calls [][]string
+	_, err := New(remote, "master", repo.WorkDir, log.NewNopLogger(), SetOffline(), recordArgs(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"clone", "fetch", "pull", "ls-remote"} {
+		if call := findCall(calls, cmd); call != nil {
+			t.Errorf("unexpected network command %v", call)
+		}
+	}
+}
+
+func TestAuthorStats(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitAs := func(email, name, content string) {
+		writeFile(t, dir, name, content)
+		git(t, dir, "add", name)
+		git(t, dir, "-c", "user.email="+email, "commit", "-q", "-m", "commit by "+email)
+	}
+	commitAs("alice@example.com", "a", "1\n2\n")
+	commitAs("bob@example.com", "b", "1\n")
+	commitAs("alice@example.com", "a", "1\n")
+
+	stats, err := repo.AuthorStats("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]AuthorStat{
+		"alice@example.com": {Commits: 2, Added: 2, Deleted: 1},
+		"bob@example.com":   {Commits: 1, Added: 1},
+		// the initial commit of the remote
+		"test@example.com": {Commits: 1, Added: 1},
+	}
+	if len(stats) != len(want) {
+		t.Errorf("unexpected authors %v", stats)
+	}
+	for author, stat := range want {
+		if stats[author] != stat {
+			t.Errorf("%s: expected %+v, got %+v", author, stat, stats[author])
+		}
+	}
+}
+
+func TestShallowExclude(t *testing.T) {
+	remote, seed := newRemote(t)
+	git(t, seed, "tag", "old")
+	commitFile(t, seed, "file", "1\n", "second commit")
+	commitFile(t, seed, "file", "2\n", "third commit")
+	git(t, seed, "push", "-q", "origin", "master", "old")
+
+	// git ignores the shallow options for plain local paths
+	repo := newRepo(t, "file://"+remote, SetShallowExclude("old"))
+	if count := git(t, repo.RepoDir, "rev-list", "--count", "HEAD"); count != "2" {
+		t.Errorf("expected 2 commits, got %s", count)
+	}
+	if !repo.gitPathExists("shallow") {
+		t.Error("expected a shallow clone")
+	}
+}
+
+func TestEnsureClean(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	if err := repo.EnsureClean(); err != nil {
+		t.Fatalf("expected a clean repo, got %v", err)
+	}
+
+	diverge(t, repo.RepoDir, "file", "base\n", "ours\n", "theirs\n")
+	cmd := exec.Command("git", "rebase", "other")
+	cmd.Dir = repo.RepoDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("expected the rebase to conflict: %s", out)
+	}
+	err := repo.EnsureClean()
+	if notClean, ok := err.(*NotCleanError); !ok || notClean.InProgress != "rebase" {
+		t.Errorf("expected a rebase in progress, got %v", err)
+	}
+}
+
+func TestPushRefspec(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	git(t, repo.RepoDir, "checkout", "-q", "-b", "feature")
+	sha := commitFile(t, repo.RepoDir, "file", "feature\n", "feature commit")
+
+	if err := repo.PushRefspec("origin", "feature:refs/heads/published"); err != nil {
+		t.Fatal(err)
+	}
+	if got := git(t, remote, "rev-parse", "refs/heads/published"); got != sha {
+		t.Errorf("expected published at %s, got %s", sha, got)
+	}
+	cmd := exec.Command("git", "rev-parse", "--verify", "-q", "refs/heads/feature")
+	cmd.Dir = remote
+	if err := cmd.Run(); err == nil {
+		t.Error("feature was pushed under its own name")
+	}
+}
+
+func TestCommitGraph(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	base := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "checkout", "-q", "-b", "other")
+	side := commitFile(t, dir, "side", "side\n", "side commit")
+	git(t, dir, "checkout", "-q", "master")
+	main := commitFile(t, dir, "main", "main\n", "main commit")
+	git(t, dir, "merge", "-q", "--no-ff", "-m", "merge other", "other")
+	merge := git(t, dir, "rev-parse", "HEAD")
+
+	nodes, err := repo.CommitGraph(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents := make(map[string]string)
+	refs := make(map[string][]string)
+	for _, node := range nodes {
+		parents[node.Commit] = strings.Join(node.Parents, " ")
+		refs[node.Commit] = node.Refs
+	}
+	want := map[string]string{
+		merge: main + " " + side,
+		main:  base,
+		side:  base,
+		base:  "",
+	}
+	if len(parents) != len(want) {
+		t.Errorf("expected %d commits, got %d", len(want), len(parents))
+	}
+	for commit, p := range want {
+		if parents[commit] != p {
+			t.Errorf("%s: expected parents %q, got %q", commit, p, parents[commit])
+		}
+	}
+	if nodes[0].Commit != merge {
+		t.Errorf("expected the merge first, got %s", nodes[0].Commit)
+	}
+	if r := strings.Join(refs[merge], " "); !strings.Contains(r, "HEAD refs/heads/master") {
+		t.Errorf("unexpected refs of the merge: %s", r)
+	}
+	if r := strings.Join(refs[side], " "); r != "refs/heads/other" {
+		t.Errorf("unexpected refs of the side commit: %s", r)
+	}
+}
+
+func TestCommitDate(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dates := func() (int64, int64) {
+		t.Helper()
+		fields := strings.Fields(git(t, repo.RepoDir, "log", "-1", "--format=%at %ct"))
+		author, _ := strconv.ParseInt(fields[0], 10, 64)
+		committer, _ := strconv.ParseInt(fields[1], 10, 64)
+		return author, committer
+	}
+
+	writeFile(t, repo.RepoDir, "file", "epoch\n")
+	if _, err := repo.CommitAll("epoch date", SetCommitDate("@1500000000 +0000")); err != nil {
+		t.Fatal(err)
+	}
+	if author, committer := dates(); author != 1500000000 || committer != 1500000000 {
+		t.Errorf("expected both dates at 1500000000, got %d and %d", author, committer)
+	}
+
+	writeFile(t, repo.RepoDir, "file", "relative\n")
+	if _, err := repo.CommitAll("relative date", SetCommitDate("2 days ago")); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Now().Add(-48 * time.Hour).Unix()
+	author, committer := dates()
+	for _, date := range []int64{author, committer} {
+		if date < want-60 || date > want+60 {
+			t.Errorf("expected a date around %d, got %d", want, date)
+		}
+	}
+}
+
+func TestResetToUpstream(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote)
+	commitFile(t, repo.RepoDir, "local", "local\n", "local commit")
+	writeFile(t, repo.RepoDir, "README", "uncommitted\n")
+	upstream := commitFile(t, seed, "upstream", "upstream\n", "upstream commit")
+	git(t, seed, "push", "-q")
+
+	if err := repo.ResetToUpstream(true); err != nil {
+		t.Fatal(err)
+	}
+	if head := git(t, repo.RepoDir, "rev-parse", "HEAD"); head != upstream {
+		t.Errorf("expected HEAD at %s, got %s", upstream, head)
+	}
+	if status := git(t, repo.RepoDir, "status", "--porcelain"); status != "" {
+		t.Errorf("expected a clean working tree, got:\n%s", status)
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	first := git(t, repo.RepoDir, "rev-parse", "HEAD")
+	second := commitFile(t, repo.RepoDir, "dir/file", "content\n", "add file")
+
+	if changed, err := repo.FileChanged("dir/file", first, second); err != nil || !changed {
+		t.Errorf("dir/file: expected a change, got %v, %v", changed, err)
+	}
+	if changed, err := repo.FileChanged("dir", first, second); err != nil || !changed {
+		t.Errorf("dir: expected a change, got %v, %v", changed, err)
+	}
+	if changed, err := repo.FileChanged("README", first, second); err != nil || changed {
+		t.Errorf("README: expected no change, got %v, %v", changed, err)
+	}
+	if _, err := repo.FileChanged("README", first, "no-such-ref"); err == nil {
+		t.Error("expected an error for an unknown ref")
+	}
+}
+
+func TestTagsOnBranch(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	first := git(t, dir, "rev-parse", "HEAD")
+	gitAt(t, dir, "@1500000000 +0000", "tag", "-a", "-m", "first release", "v1")
+	git(t, dir, "checkout", "-q", "-b", "other")
+	commitFile(t, dir, "other", "other\n", "other commit")
+	git(t, dir, "tag", "elsewhere")
+	git(t, dir, "checkout", "-q", "master")
+	writeFile(t, dir, "file", "second\n")
+	git(t, dir, "add", "file")
+	gitAt(t, dir, "@1600000000 +0000", "commit", "-q", "-m", "second commit")
+	second := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "tag", "v2")
+
+	tags, err := repo.TagsOnBranch("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TagInfo{
+		{Name: "v1", Commit: first, Date: time.Unix(1500000000, 0)},
+		{Name: "v2", Commit: second, Date: time.Unix(1600000000, 0)},
+	}
+	if len(tags) != len(want) {
+		t.Fatalf("expected %v, got %v", want, tags)
+	}
+	for i, tag := range tags {
+		if tag.Name != want[i].Name || tag.Commit != want[i].Commit || !tag.Date.Equal(want[i].Date) {
+			t.Errorf("tag %d: expected %+v, got %+v", i, want[i], tag)
+		}
+	}
+}
+
+func TestForceCheckout(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	git(t, repo.RepoDir, "checkout", "-q", "-b", "other")
+	commitFile(t, repo.RepoDir, "README", "other\n", "other commit")
+	git(t, repo.RepoDir, "checkout", "-q", "master")
+	writeFile(t, repo.RepoDir, "README", "local edit\n")
+
+	if err := repo.Checkout("other"); err == nil {
+		t.Fatal("expected the checkout to fail over the local edit")
+	}
+	if err := repo.Checkout("other", SetForceCheckout()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(repo.RepoDir, "README"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "other\n" {
+		t.Errorf("expected README of other, got %q", data)
+	}
+	if branch, _ := repo.Branch(); branch != "other" {
+		t.Errorf("expected other checked out, got %s", branch)
+	}
+}
+
+func TestBlameAtRef(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	old := commitFile(t, dir, "file", "one\ntwo\n", "old version")
+	writeFile(t, dir, "file", "one\nTWO\nthree\n")
+	git(t, dir, "add", "file")
+	git(t, dir, "-c", "user.name=Other", "-c", "user.email=other@example.com", "commit", "-q", "-m", "new version")
+
+	lines, err := repo.BlameAtRef("file", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %+v", lines)
+	}
+	for i, content := range []string{"one", "two"} {
+		line := lines[i]
+		if line.Commit != old || line.Content != content || line.LineNo != i+1 {
+			t.Errorf("line %d: got %+v", i+1, line)
+		}
+		if line.AuthorName != "Test User" || line.AuthorEmail != "test@example.com" || line.Time.IsZero() {
+			t.Errorf("line %d: unexpected author %+v", i+1, line)
+		}
+	}
+}
+
+func TestShowTag(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	head := git(t, dir, "rev-parse", "HEAD")
+	gitAt(t, dir, "@1500000000 +0000", "tag", "-a", "-m", "release notes\n\nmore notes", "annotated")
+	git(t, dir, "tag", "light")
+
+	detail, err := repo.ShowTag("annotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TagDetail{
+		Name:        "annotated",
+		Annotated:   true,
+		Commit:      head,
+		Tagger:      "Test User",
+		TaggerEmail: "test@example.com",
+		Message:     "release notes\n\nmore notes",
+	}
+	if !detail.Date.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("unexpected date %v", detail.Date)
+	}
+	detail.Date = time.Time{}
+	if *detail != want {
+		t.Errorf("expected %+v, got %+v", want, *detail)
+	}
+
+	detail, err = repo.ShowTag("light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *detail != (TagDetail{Name: "light", Commit: head}) {
+		t.Errorf("unexpected lightweight tag %+v", *detail)
+	}
+}
+
+func TestVerifyConnectivity(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	if err := repo.VerifyConnectivity(); err != nil {
+		t.Fatalf("expected a complete repo, got %v", err)
+	}
+
+	commitFile(t, repo.RepoDir, "file", "will go missing\n", "add file")
+	blob := git(t, repo.RepoDir, "rev-parse", "HEAD:file")
+	if err := os.Remove(filepath.Join(repo.RepoDir, ".git", "objects", blob[:2], blob[2:])); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.VerifyConnectivity()
+	missing, ok := err.(*MissingObjectsError)
+	if !ok || len(missing.Objects) != 1 || missing.Objects[0] != blob {
+		t.Errorf("expected %s to be missing, got %v", blob, err)
+	}
+}
+
+func TestLogSeparators(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	subject := "odd\x1esubject\x1fwith separators"
+	commitFile(t, repo.RepoDir, "file", "needle\n", subject)
+
+	if _, err := repo.SearchIntroduced("needle", false); err == nil {
+		t.Error("expected the default separators to fail on the message")
+	}
+	commits, err := repo.SearchIntroduced("needle", false, SetLogSeparators("<<record>>", "<<field>>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].Subject != subject {
+		t.Errorf("expected one commit with subject %q, got %+v", subject, commits)
+	}
+}
+
+func TestParallelCheckout(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	git(t, repo.RepoDir, "branch", "other")
+	head := git(t, repo.RepoDir, "rev-parse", "HEAD")
+
+	worktrees, err := repo.ParallelCheckout([]string{"master", "other"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(worktrees) != 2 {
+		t.Fatalf("expected 2 worktrees, got %d", len(worktrees))
+	}
+	commits := make(map[string]bool)
+	for i, wt := range worktrees {
+		writeFile(t, wt.RepoDir, "file", "worktree "+strconv.Itoa(i)+"\n")
+		sha, err := wt.CommitAll("commit in worktree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits[sha] = true
+	}
+	if len(commits) != 2 {
+		t.Errorf("expected 2 distinct commits, got %v", commits)
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("the main working tree moved to %s", sha)
+	}
+
+	if err := repo.CleanupWorktrees(); err != nil {
+		t.Fatal(err)
+	}
+	for _, wt := range worktrees {
+		if _, err := os.Stat(wt.RepoDir); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", wt.RepoDir)
+		}
+	}
+	if list := git(t, repo.RepoDir, "worktree", "list", "--porcelain"); strings.Count(list, "worktree ") != 1 {
+		t.Errorf("expected only the main worktree, got:\n%s", list)
+	}
+}
+
+func TestParallelCheckoutFailure(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	git(t, repo.RepoDir, "branch", "other")
+	baseDir := t.TempDir()
+
+	if _, err := repo.ParallelCheckout([]string{"master", "other", "no-such-ref"}, baseDir); err == nil {
+		t.Fatal("expected an error for an unknown ref")
+	}
+	if list := git(t, repo.RepoDir, "worktree", "list", "--porcelain"); strings.Count(list, "worktree ") != 1 {
+		t.Errorf("expected only the main worktree, got:\n%s", list)
+	}
+	if entries, _ := ioutil.ReadDir(baseDir); len(entries) != 0 {
+		t.Errorf("expected no worktree dirs, got %d", len(entries))
+	}
+	if len(repo.worktrees) != 0 {
+		t.Errorf("expected no worktrees to clean up, got %v", repo.worktrees)
+	}
+}
+
+func TestCommitCommitter(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	git(t, dir, "checkout", "-q", "-b", "other")
+	writeFile(t, dir, "file", "picked\n")
+	git(t, dir, "add", "file")
+	gitAt(t, dir, "@1500000000 +0000", "-c", "user.name=Author", "-c", "user.email=author@example.com",
+		"commit", "-q", "-m", "to be picked")
+	git(t, dir, "checkout", "-q", "master")
+	gitAt(t, dir, "@1600000000 +0000", "-c", "user.name=Picker", "-c", "user.email=picker@example.com",
+		"cherry-pick", "other")
+
+	name, email, date, err := repo.CommitCommitter("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Picker" || email != "picker@example.com" || !date.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("unexpected committer %s <%s> at %v", name, email, date)
+	}
+	author, err := repo.CommitAuthorIdentity("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if author.Name != "Author" || author.Email != "author@example.com" || !author.Date.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("unexpected author %+v", *author)
+	}
+}
+
+func TestPlanAddCommitPush(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitFile(t, dir, "committed", "committed\n", "local commit")
+	writeFile(t, dir, "README", "changed\n")
+	writeFile(t, dir, "new", "new\n")
+	before := git(t, remote, "rev-parse", "master")
+
+	plan, err := repo.PlanAddCommitPush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Commit || !plan.Push || plan.Upstream != "origin/master" || plan.Ahead != 1 {
+		t.Errorf("unexpected plan %+v", *plan)
+	}
+
+	if _, err := repo.AddCommitPush("add and push"); err != nil {
+		t.Fatal(err)
+	}
+	committed := strings.Fields(git(t, dir, "show", "--format=", "--name-only", "HEAD"))
+	if strings.Join(committed, " ") != strings.Join(plan.Files, " ") {
+		t.Errorf("planned %v, committed %v", plan.Files, committed)
+	}
+	pushed := git(t, remote, "rev-list", "--count", before+"..master")
+	if pushed != strconv.Itoa(plan.Ahead+1) {
+		t.Errorf("planned %d commits to push, pushed %s", plan.Ahead+1, pushed)
+	}
+}
+
+func TestBinaryChangedFiles(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	before := git(t, dir, "rev-parse", "HEAD")
+	writeFile(t, dir, "image.bin", "\x00\x01\x02binary\x00")
+	writeFile(t, dir, "README", "text\n")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "binary and text")
+
+	files, err := repo.BinaryChangedFiles(before, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "image.bin" {
+		t.Errorf("expected only image.bin, got %v", files)
+	}
+}
+
+func TestFindRenames(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitFile(t, dir, "old", "line 1\nline 2\nline 3\nline 4\nline 5\nline 6\nline 7\nline 8\nline 9\nline 10\n", "add old")
+	before := git(t, dir, "rev-parse", "HEAD")
+	// keep less than half of the file, so git doesn't see a rename by default
+	git(t, dir, "mv", "old", "new")
+	writeFile(t, dir, "new", "line 1\nline 2\nline 3\nline 4\nchanged 5\nchanged 6\nchanged 7\nchanged 8\nchanged 9\nchanged 10\n")
+	git(t, dir, "commit", "-q", "-a", "-m", "move and edit")
+
+	diffs, err := repo.DiffStatus(before, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || diffs[0].Stat == StatRenamed || diffs[1].Stat == StatRenamed {
+		t.Errorf("expected a delete and an add by default, got %+v %+v", diffs[0], diffs[len(diffs)-1])
+	}
+	diffs, err = repo.DiffStatus(before, "HEAD", SetFindRenames(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Stat != StatRenamed || diffs[0].OldFilename != "old" || diffs[0].Filename != "new" {
+		t.Errorf("expected a rename at 30%%, got %d diffs: %+v", len(diffs), diffs[0])
+	}
+}
+
+func TestStashByIndex(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	readme := func() string {
+		t.Helper()
+		data, err := ioutil.ReadFile(filepath.Join(repo.RepoDir, "README"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, content := range []string{"first\n", "second\n"} {
+		writeFile(t, repo.RepoDir, "README", content)
+		if err := repo.Stash("stash " + content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// index 1 is the older stash
+	if err := repo.StashApply(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readme(); got != "first\n" {
+		t.Errorf("expected the first stash applied, got %q", got)
+	}
+	if entries, _ := repo.StashList(); len(entries) != 2 {
+		t.Errorf("apply removed a stash, %d left", len(entries))
+	}
+	git(t, repo.RepoDir, "checkout", "--", "README")
+
+	if err := repo.StashDrop(1); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := repo.StashList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].Message, "stash second") {
+		t.Errorf("expected only the second stash left, got %+v", entries)
+	}
+
+	for _, index := range []int{-1, 1} {
+		if err := repo.StashApply(index); err != ErrNoSuchStash {
+			t.Errorf("apply %d: expected ErrNoSuchStash, got %v", index, err)
+		}
+		if err := repo.StashDrop(index); err != ErrNoSuchStash {
+			t.Errorf("drop %d: expected ErrNoSuchStash, got %v", index, err)
+		}
+	}
+}
+
+func TestCommitWithTree(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	head := git(t, dir, "rev-parse", "HEAD")
+	writeFile(t, dir, "file", "in the tree\n")
+	git(t, dir, "add", "file")
+	tree := git(t, dir, "write-tree")
+	git(t, dir, "reset", "-q")
+	writeFile(t, dir, "untouched", "local\n")
+
+	sha, err := repo.CommitWithTree(tree, "tree commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := git(t, dir, "rev-parse", "refs/heads/master"); got != sha {
+		t.Errorf("expected master at %s, got %s", sha, got)
+	}
+	if parent := git(t, dir, "rev-parse", sha+"^"); parent != head {
+		t.Errorf("expected parent %s, got %s", head, parent)
+	}
+	if got := git(t, dir, "rev-parse", sha+"^{tree}"); got != tree {
+		t.Errorf("expected tree %s, got %s", tree, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "untouched")); err != nil {
+		t.Errorf("working tree changed: %v", err)
+	}
+}
+
+func TestWorktreePrune(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := filepath.Join(t.TempDir(), "stale")
+	if _, err := repo.WorktreeAdd(dir, "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if list := git(t, repo.RepoDir, "worktree", "list", "--porcelain"); !strings.Contains(list, "prunable") {
+		t.Fatalf("expected a prunable worktree, got:\n%s", list)
+	}
+
+	if err := repo.WorktreePrune(); err != nil {
+		t.Fatal(err)
+	}
+	if list := git(t, repo.RepoDir, "worktree", "list", "--porcelain"); strings.Contains(list, dir) {
+		t.Errorf("stale worktree not pruned:\n%s", list)
+	}
+}
+
+func TestWorkingState(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitFile(t, dir, "both", "base\n", "add both")
+	writeFile(t, dir, "staged", "staged\n")
+	git(t, dir, "add", "staged")
+	writeFile(t, dir, "both", "staged\n")
+	git(t, dir, "add", "both")
+	writeFile(t, dir, "both", "unstaged\n")
+	writeFile(t, dir, "README", "unstaged\n")
+	writeFile(t, dir, "untracked", "untracked\n")
+
+	ws, err := repo.WorkingState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(diffs []*DiffStat) string {
+		var parts []string
+		for _, ds := range diffs {
+			parts = append(parts, fmt.Sprintf("%d:%s", ds.Stat, ds.Filename))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, " ")
+	}
+	for _, bucket := range []struct {
+		name  string
+		diffs []*DiffStat
+		want  string
+	}{
+		{"staged", ws.Staged, fmt.Sprintf("%d:staged %d:both", StatNew, StatModified)},
+		{"unstaged", ws.Unstaged, fmt.Sprintf("%d:README %d:both", StatModified, StatModified)},
+		{"untracked", ws.Untracked, fmt.Sprintf("%d:untracked", StatNew)},
+	} {
+		if got := names(bucket.diffs); got != bucket.want {
+			t.Errorf("%s: expected %s, got %s", bucket.name, bucket.want, got)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	chdir(t, t.TempDir())
+	if err := os.Mkdir("rel", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, workDir := range []string{"rel", t.TempDir()} {
+		repo, err := Init("x", workDir, log.NewNopLogger(), SetInitialBranch("trunk"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo.RepoDir != filepath.Join(workDir, "x") {
+			t.Errorf("unexpected RepoDir %s", repo.RepoDir)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, "x", ".git")); err != nil {
+			t.Errorf("repo not created in %s: %v", repo.RepoDir, err)
+		}
+		if head := git(t, repo.RepoDir, "symbolic-ref", "HEAD"); head != "refs/heads/trunk" {
+			t.Errorf("%s: expected HEAD at trunk, got %s", workDir, head)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("rel", "rel")); !os.IsNotExist(err) {
+		t.Error("repo created relative to workDir twice")
+	}
+}
+
+func TestCommitFiles(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	root := git(t, dir, "rev-parse", "HEAD")
+	writeFile(t, dir, "README", "changed\n")
+	writeFile(t, dir, "new", "new\n")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "change and add")
+
+	for _, c := range []struct {
+		commit string
+		want   map[string]ModType
+	}{
+		{"HEAD", map[string]ModType{"README": StatModified, "new": StatNew}},
+		{root, map[string]ModType{"README": StatNew}},
+	} {
+		files, err := repo.CommitFiles(c.commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(c.want) {
+			t.Errorf("%s: expected %d files, got %d", c.commit, len(c.want), len(files))
+		}
+		for _, f := range files {
+			if stat, ok := c.want[f.Filename]; !ok || f.Stat != stat {
+				t.Errorf("%s: unexpected file %+v", c.commit, *f)
+			}
+		}
+	}
+}
+
+func TestPushOptions(t *testing.T) {
+	remote, _ := newRemote(t)
+	git(t, remote, "config", "receive.advertisePushOptions", "true")
+	received := filepath.Join(t.TempDir(), "options")
+	hook := "#!/bin/sh\necho \"$GIT_PUSH_OPTION_COUNT $GIT_PUSH_OPTION_0 $GIT_PUSH_OPTION_1\" > " + received + "\n"
+	if err := ioutil.WriteFile(filepath.Join(remote, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var calls [][]string
+	repo := newRepo(t, remote, recordArgs(&calls))
+	commitFile(t, repo.RepoDir, "file", "content\n", "commit")
+
+	if err := repo.Push(SetPushOption("ci.skip"), SetPushOption("merge_request.create")); err != nil {
+		t.Fatal(err)
+	}
+	push := strings.Join(findCall(calls, "push"), " ")
+	if !strings.Contains(push, "-o ci.skip -o merge_request.create") {
+		t.Errorf("expected both push options, got %s", push)
+	}
+	data, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "2 ci.skip merge_request.create" {
+		t.Errorf("remote received %q", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote, SetReadOnly())
+	head := git(t, seed, "rev-parse", "HEAD")
+
+	writeFile(t, repo.RepoDir, "file", "content\n")
+	if _, err := repo.CommitAll("blocked"); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if err := repo.Push(); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly from push, got %v", err)
+	}
+	if status := git(t, repo.RepoDir, "status", "--porcelain"); status != "?? file" {
+		t.Errorf("the repo was changed:\n%s", status)
+	}
+	if sha, err := repo.CurrentCommit(); err != nil || sha != head {
+		t.Errorf("expected to read %s, got %s, %v", head, sha, err)
+	}
+}
+
+func TestHasLFS(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		attributes string
+		want       bool
+	}{
+		{"lfs", "*.bin filter=lfs diff=lfs merge=lfs -text\n", true},
+		{"no lfs", "*.txt text eol=lf\n", false},
+		{"commented out", "# *.bin filter=lfs diff=lfs merge=lfs -text\n", false},
+		{"no attributes", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			remote, _ := newRemote(t)
+			repo := newRepo(t, remote)
+			if c.attributes != "" {
+				writeFile(t, repo.RepoDir, ".gitattributes", c.attributes)
+			}
+			lfs, err := repo.HasLFS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lfs != c.want {
+				t.Errorf("expected %v, got %v", c.want, lfs)
+			}
+		})
+	}
+}
+
+func TestSquashMerge(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	head := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "checkout", "-q", "-b", "feature")
+	for i := 1; i <= 3; i++ {
+		name := "file" + strconv.Itoa(i)
+		commitFile(t, dir, name, name+"\n", "add "+name)
+	}
+	git(t, dir, "checkout", "-q", "master")
+
+	if err := repo.SquashMerge("feature", "squashed feature"); err != nil {
+		t.Fatal(err)
+	}
+	if commits := git(t, dir, "rev-list", head+"..HEAD"); len(strings.Fields(commits)) != 1 {
+		t.Fatalf("expected 1 new commit, got %q", commits)
+	}
+	if parent := git(t, dir, "rev-parse", "HEAD^"); parent != head {
+		t.Errorf("expected the squash on top of %s, got parent %s", head, parent)
+	}
+	if subject := git(t, dir, "log", "-1", "--format=%s"); subject != "squashed feature" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for i := 1; i <= 3; i++ {
+		name := "file" + strconv.Itoa(i)
+		if content := git(t, dir, "show", "HEAD:"+name); content != name {
+			t.Errorf("unexpected content of %s in the squash: %q", name, content)
+		}
+	}
+}
+
+func TestSquashMergeConflict(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	diverge(t, repo.RepoDir, "file", "base\n", "ours\n", "theirs\n")
+	head := git(t, repo.RepoDir, "rev-parse", "HEAD")
+
+	err := repo.SquashMerge("other", "squashed")
+	conflict, ok := err.(*MergeConflictError)
+	if !ok || len(conflict.Files) != 1 || conflict.Files[0] != "file" {
+		t.Fatalf("expected a conflict in file, got %v", err)
+	}
+	if errors.Cause(err) != ErrMergeConflict {
+		t.Errorf("expected ErrMergeConflict as cause, got %v", errors.Cause(err))
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("committed %s despite the conflict", sha)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	remote, _ := newRemote(t)
+	var calls [][]string
+	newRepo(t, remote, SetJobs(4), recordArgs(&calls))
+	clone := strings.Join(findCall(calls, "clone"), " ")
+	if !strings.Contains(clone, "--jobs 4") {
+		t.Errorf("expected --jobs 4, got %s", clone)
+	}
+
+	_, err := New(remote, "master", t.TempDir(), log.NewNopLogger(), SetJobs(0))
+	if err == nil {
+		t.Error("expected an error for 0 jobs")
+	}
+}
+
+func TestSearchIntroduced(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	added := commitFile(t, dir, "file", "needle\n", "add needle")
+	commitFile(t, dir, "other", "unrelated\n", "unrelated")
+	removed := commitFile(t, dir, "file", "hay\n", "remove needle")
+
+	for _, isRegex := range []bool{false, true} {
+		term := "needle"
+		if isRegex {
+			term = "nee+dle"
+		}
+		commits, err := repo.SearchIntroduced(term, isRegex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(commits) != 2 || commits[0].Hash != removed || commits[1].Hash != added {
+			t.Errorf("%s: expected %s and %s, got %+v", term, removed, added, commits)
+		}
+	}
+}
+
+func TestCheckoutIndex(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	commitFile(t, repo.RepoDir, "other", "committed\n", "add other")
+	writeFile(t, repo.RepoDir, "README", "modified\n")
+	writeFile(t, repo.RepoDir, "other", "modified\n")
+
+	if err := repo.CheckoutIndex("README"); err != nil {
+		t.Fatal(err)
+	}
+	if status := git(t, repo.RepoDir, "status", "--porcelain"); status != "M other" {
+		t.Errorf("expected only other to be modified, got:\n%s", status)
+	}
+}
+
+func TestHTTPOptions(t *testing.T) {
+	remote, _ := newRemote(t)
+	var calls [][]string
+	repo := newRepo(t, remote, SetHTTPPostBuffer(524288000), SetLowSpeedLimit(1000, 60), recordArgs(&calls))
+	commitFile(t, repo.RepoDir, "file", "content\n", "commit")
+	if err := repo.Push(); err != nil {
+		t.Fatal(err)
+	}
+	push := strings.Join(findCall(calls, "push"), " ")
+	for _, arg := range []string{"-c http.postBuffer=524288000", "-c http.lowSpeedLimit=1000", "-c http.lowSpeedTime=60"} {
+		if !strings.Contains(push, arg) {
+			t.Errorf("expected %s in %s", arg, push)
+		}
+	}
+}
+
+func TestResolveUsing(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	diverge(t, repo.RepoDir, "file", "base\n", "ours\n", "theirs\n")
+	mergeConflict(t, repo.RepoDir)
+
+	files, err := repo.ConflictedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "file" {
+		t.Fatalf("expected a conflict in file, got %v", files)
+	}
+	if err := repo.ResolveUsing("file", Theirs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(repo.RepoDir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "theirs\n" {
+		t.Errorf("expected their version, got %q", data)
+	}
+	if files, err := repo.ConflictedFiles(); err != nil || len(files) != 0 {
+		t.Errorf("expected no conflicts left, got %v, %v", files, err)
+	}
+}
+
+func TestNewAtTag(t *testing.T) {
+	remote, seed := newRemote(t)
+	tagged := git(t, seed, "rev-parse", "HEAD")
+	git(t, seed, "tag", "-a", "-m", "release", "v1")
+	commitFile(t, seed, "file", "after the tag\n", "after the tag")
+	git(t, seed, "push", "-q", "origin", "master", "v1")
+
+	workDir := t.TempDir()
+	for run := 1; run <= 2; run++ {
+		repo, err := New(remote, "v1", workDir, log.NewNopLogger())
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if !repo.isDetached() {
+			t.Errorf("run %d: expected a detached HEAD", run)
+		}
+		if head, _ := repo.CurrentCommit(); head != tagged {
+			t.Errorf("run %d: expected HEAD at %s, got %s", run, tagged, head)
+		}
+	}
+
+	if _, err := New(remote, "no-such-ref", t.TempDir(), log.NewNopLogger()); err == nil {
+		t.Error("expected an error for an unknown ref")
+	}
+}
+
+func TestTreeEntries(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	writeFile(t, dir, "dir/file", "file\n")
+	writeFile(t, dir, "dir/script", "#!/bin/sh\n")
+	if err := os.Chmod(filepath.Join(dir, "dir/script"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "dir/sub/nested", "nested\n")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "add dir")
+
+	entries, err := repo.TreeEntries("HEAD", "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TreeEntry{
+		{Mode: "100644", Type: "blob", SHA: git(t, dir, "rev-parse", "HEAD:dir/file"), Name: "file"},
+		{Mode: "100755", Type: "blob", SHA: git(t, dir, "rev-parse", "HEAD:dir/script"), Name: "script"},
+		{Mode: "040000", Type: "tree", SHA: git(t, dir, "rev-parse", "HEAD:dir/sub"), Name: "sub"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry != want[i] {
+			t.Errorf("expected %+v, got %+v", want[i], entry)
+		}
+	}
+}
+
+func TestDirtyReason(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	if reason, err := repo.DirtyReason(); err != nil || reason != "" {
+		t.Errorf("expected no reason for a clean tree, got %q, %v", reason, err)
+	}
+
+	commitFile(t, dir, "tracked", "tracked\n", "add tracked")
+	writeFile(t, dir, "a", "a\n")
+	writeFile(t, dir, "b", "b\n")
+	git(t, dir, "add", "a", "b")
+	writeFile(t, dir, "README", "modified\n")
+	writeFile(t, dir, "c", "c\n")
+	writeFile(t, dir, "d", "d\n")
+	writeFile(t, dir, "e", "e\n")
+
+	reason, err := repo.DirtyReason()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2 staged, 1 modified, 3 untracked"; reason != want {
+		t.Errorf("expected %q, got %q", want, reason)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	remote, _ := newRemote(t)
+	const token = "s3cr3t-t0ken"
+	backend := filepath.Join(git(t, remote, "--exec-path"), "git-http-backend")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "x-access-token" || pass != token {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h := &cgi.Handler{
+			Path:   backend,
+			Env:    []string{"GIT_PROJECT_ROOT=" + filepath.Dir(remote), "GIT_HTTP_EXPORT_ALL=1"},
+			Stderr: ioutil.Discard,
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	repo := newRepo(t, srv.URL+"/remote.git", SetAuthToken(token))
+	if url, _ := repo.RemoteURL("origin"); strings.Contains(url, token) {
+		t.Errorf("token stored in the remote URL %s", url)
+	}
+	if _, err := New(srv.URL+"/remote.git", "master", t.TempDir(), log.NewNopLogger(), SetAuthToken("wrong")); err == nil {
+		t.Error("expected the clone to fail with a wrong token")
+	}
+
+	// git mentions the URL in its error, which makes the token show up
+	_, err := New(srv.URL+"/"+token+"/remote.git", "master", t.TempDir(), log.NewNopLogger(), SetAuthToken(token))
+	if err == nil {
+		t.Fatal("expected the clone of a missing repo to fail")
+	}
+	if strings.Contains(err.Error(), token) {
+		t.Errorf("token not redacted: %v", err)
+	}
+	if !strings.Contains(err.Error(), "[redacted]") {
+		t.Errorf("expected the token to be redacted in %v", err)
+	}
+}
+
+func TestSkipEmptyCommit(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote, SetSkipEmptyCommit())
+	head := git(t, repo.RepoDir, "rev-parse", "HEAD")
+
+	skipped, err := repo.AddCommitPush("nothing changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !skipped {
+		t.Error("expected the commit to be skipped")
+	}
+	if sha, err := repo.Commit("nothing changed"); err != nil || sha != "" {
+		t.Errorf("expected an empty hash and no error, got %q, %v", sha, err)
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("an empty commit %s was created", sha)
+	}
+	if sha := git(t, remote, "rev-parse", "master"); sha != head {
+		t.Errorf("pushed %s", sha)
+	}
+
+	writeFile(t, repo.RepoDir, "README", "changed\n")
+	if skipped, err := repo.AddCommitPush("changed"); err != nil || skipped {
+		t.Fatalf("expected a commit, got skipped %v, %v", skipped, err)
+	}
+	if sha := git(t, remote, "rev-parse", "master"); sha == head {
+		t.Error("the change wasn't pushed")
+	}
+}
+
+func TestChangelogFirstParent(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	base := git(t, dir, "rev-parse", "HEAD")
+	var merges []string
+	for _, feature := range []string{"one", "two"} {
+		git(t, dir, "checkout", "-q", "-b", feature)
+		commitFile(t, dir, feature, "first\n", feature+" first")
+		commitFile(t, dir, feature, "second\n", feature+" second")
+		git(t, dir, "checkout", "-q", "master")
+		git(t, dir, "merge", "-q", "--no-ff", "-m", "merge "+feature, feature)
+		merges = append([]string{git(t, dir, "rev-parse", "HEAD")}, merges...)
+	}
+
+	commits, err := repo.ChangelogCommits(base, "master", ChangelogOpts{FirstParent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range commits {
+		got = append(got, c.Hash)
+	}
+	if strings.Join(got, " ") != strings.Join(merges, " ") {
+		t.Errorf("expected the merges %v, got %v", merges, got)
+	}
+	all, err := repo.ChangelogCommits(base, "master", ChangelogOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 {
+		t.Errorf("expected 6 commits without FirstParent, got %d", len(all))
+	}
+}
+
+func TestArchiveSubtree(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	writeFile(t, dir, "sub/a", "a\n")
+	writeFile(t, dir, "sub/deeper/b", "b\n")
+	writeFile(t, dir, "outside", "outside\n")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "add files")
+
+	var buf bytes.Buffer
+	if err := repo.ArchiveSubtree("HEAD", "sub", &buf, "tar"); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			files = append(files, hdr.Name)
+		}
+	}
+	sort.Strings(files)
+	if strings.Join(files, " ") != "a deeper/b" {
+		t.Errorf("expected only the files of sub, got %v", files)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	remote, seed := newRemote(t)
+	commitFile(t, seed, "file", "second\n", "second commit")
+	git(t, seed, "push", "-q")
+
+	// git ignores --depth for plain local paths
+	repo := newRepo(t, "file://"+remote, SetDepth(1))
+	if count := git(t, repo.RepoDir, "rev-list", "--count", "HEAD"); count != "1" {
+		t.Fatalf("expected 1 commit, got %s", count)
+	}
+
+	upstream := commitFile(t, seed, "file", "third\n", "third commit")
+	git(t, seed, "push", "-q")
+	if err := repo.CloneOrPull(); err != nil {
+		t.Fatal(err)
+	}
+	if head := git(t, repo.RepoDir, "rev-parse", "HEAD"); head != upstream {
+		t.Errorf("expected HEAD at %s, got %s", upstream, head)
+	}
+	if count := git(t, repo.RepoDir, "rev-list", "--count", "HEAD"); count != "1" {
+		t.Errorf("expected 1 commit after the update, got %s", count)
+	}
+
+	// local commits would be lost by the reset
+	local := commitFile(t, repo.RepoDir, "local", "local\n", "local commit")
+	commitFile(t, seed, "file", "fourth\n", "fourth commit")
+	git(t, seed, "push", "-q")
+	if err := repo.CloneOrPull(); errors.Cause(err) != ErrNotFastForward {
+		t.Errorf("expected ErrNotFastForward, got %v", err)
+	}
+	if head := git(t, repo.RepoDir, "rev-parse", "HEAD"); head != local {
+		t.Errorf("the local commit was lost, HEAD is at %s", head)
+	}
+
+	readOnly := newRepo(t, "file://"+remote, SetDepth(1), SetReadOnly())
+	head := git(t, readOnly.RepoDir, "rev-parse", "HEAD")
+	commitFile(t, seed, "file", "fifth\n", "fifth commit")
+	git(t, seed, "push", "-q")
+	if err := readOnly.CloneOrPull(); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if sha := git(t, readOnly.RepoDir, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("read-only repo was reset to %s", sha)
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	remote, _ := newRemote(t)
+	fork, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	if err := repo.AddRemote("fork", fork); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo.RepoDir, "fetch", "-q", "fork")
+	git(t, repo.RepoDir, "checkout", "-q", "-b", "forked", "--track", "fork/master")
+
+	url, err := repo.UpstreamURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != fork {
+		t.Errorf("expected %s, got %s", fork, url)
+	}
+
+	git(t, repo.RepoDir, "checkout", "-q", "-b", "untracked")
+	if _, err := repo.UpstreamURL(); errors.Cause(err) != ErrNoUpstream {
+		t.Errorf("expected ErrNoUpstream, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	commitFile(t, dir, "conflict", "base\n", "add conflict")
+	base := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "checkout", "-q", "-b", "other")
+	commitFile(t, dir, "first", "first\n", "first")
+	middle := commitFile(t, dir, "conflict", "theirs\n", "middle")
+	commitFile(t, dir, "third", "third\n", "third")
+	git(t, dir, "checkout", "-q", "master")
+	commitFile(t, dir, "conflict", "ours\n", "ours")
+
+	err := repo.Replay(base, "other")
+	conflict, ok := err.(*CherryPickConflictError)
+	if !ok {
+		t.Fatalf("expected a *CherryPickConflictError, got %v", err)
+	}
+	if conflict.Commit != middle || len(conflict.Files) != 1 || conflict.Files[0] != "conflict" {
+		t.Errorf("unexpected conflict %+v", *conflict)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "first")); err != nil {
+		t.Errorf("the first commit wasn't applied: %v", err)
+	}
+
+	if err := repo.ResolveUsing("conflict", Theirs); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReplayContinue(); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := git(t, dir, "log", "-4", "--format=%s"); subjects != "third\nmiddle\nfirst\nours" {
+		t.Errorf("unexpected history:\n%s", subjects)
+	}
+}
+
+func TestReplayWithoutIdentity(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	base := git(t, dir, "rev-parse", "HEAD")
+	git(t, dir, "checkout", "-q", "-b", "other")
+	commitFile(t, dir, "file", "file\n", "pick me")
+	git(t, dir, "checkout", "-q", "master")
+	// git can't commit the pick without knowing who the committer is
+	noIdentity(t, dir)
+
+	err := repo.Replay(base, "other")
+	if err == nil {
+		t.Fatal("expected the replay to fail")
+	}
+	if _, ok := err.(*CherryPickConflictError); ok {
+		t.Errorf("expected the identity error, got a conflict: %v", err)
+	}
+}
+
+func TestCurrentRef(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	ref, detached, err := repo.CurrentRef()
+	if err != nil || ref != "master" || detached {
+		t.Errorf("attached: got %s, %v, %v", ref, detached, err)
+	}
+
+	git(t, repo.RepoDir, "checkout", "-q", "--detach")
+	short := git(t, repo.RepoDir, "rev-parse", "--short", "HEAD")
+	ref, detached, err = repo.CurrentRef()
+	if err != nil || ref != short || !detached {
+		t.Errorf("detached: got %s, %v, %v", ref, detached, err)
+	}
+	if branch, err := repo.Branch(); err != nil || branch != "HEAD" {
+		t.Errorf("expected Branch to return HEAD, got %s, %v", branch, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	remote, seed := newRemote(t)
+	var calls [][]string
+	repo := newRepo(t, remote, recordArgs(&calls))
+	git(t, seed, "checkout", "-q", "-b", "feature")
+	sha := commitFile(t, seed, "file", "feature\n", "feature commit")
+	git(t, seed, "push", "-q", "origin", "feature")
+
+	if err := repo.Fetch(SetJobs(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := git(t, repo.RepoDir, "rev-parse", "refs/remotes/origin/feature"); got != sha {
+		t.Errorf("expected origin/feature at %s, got %s", sha, got)
+	}
+	if fetch := strings.Join(findCall(calls, "fetch"), " "); !strings.Contains(fetch, "--jobs 2") {
+		t.Errorf("expected --jobs 2, got %s", fetch)
+	}
+}
+
+func TestArgTransform(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote, SetArgTransform(func(args []string) []string {
+		return append([]string{"-c", "user.name=Transformed"}, args...)
+	}))
+	writeFile(t, repo.RepoDir, "file", "content\n")
+	if _, err := repo.CommitAll("transformed"); err != nil {
+		t.Fatal(err)
+	}
+	if name := git(t, repo.RepoDir, "log", "-1", "--format=%an"); name != "Transformed" {
+		t.Errorf("expected the transformed author name, got %s", name)
+	}
+}
+
+func TestPatchID(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	git(t, dir, "checkout", "-q", "-b", "other")
+	commitFile(t, dir, "other", "unrelated\n", "unrelated")
+	original := commitFile(t, dir, "file", "picked\n", "to be picked")
+	git(t, dir, "checkout", "-q", "master")
+	commitFile(t, dir, "mine", "mine\n", "mine")
+	git(t, dir, "cherry-pick", original)
+	picked := git(t, dir, "rev-parse", "HEAD")
+
+	id, err := repo.PatchID(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pickedID, err := repo.PatchID(picked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != pickedID || picked == original {
+		t.Errorf("expected equal patch ids for %s and %s, got %s and %s", original, picked, id, pickedID)
+	}
+	otherID, err := repo.PatchID("HEAD^")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherID == id {
+		t.Error("expected another patch id for another change")
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	diverge(t, repo.RepoDir, "file", "base\n", "ours\n", "theirs\n")
+
+	err := repo.Merge("other")
+	conflict, ok := err.(*MergeConflictError)
+	if !ok || len(conflict.Files) != 1 || conflict.Files[0] != "file" {
+		t.Fatalf("expected a conflict in file, got %v", err)
+	}
+	if !stderrors.Is(err, ErrMergeConflict) {
+		t.Error("expected errors.Is to match ErrMergeConflict")
+	}
+	if errors.Cause(err) != ErrMergeConflict {
+		t.Error("expected errors.Cause to return ErrMergeConflict")
+	}
+	if err := repo.AbortMerge(); err != nil {
+		t.Fatal(err)
+	}
+	if op := repo.inProgress(); op != "" {
+		t.Errorf("%s still in progress", op)
+	}
+}
+
+func TestFetchTagsOnly(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote)
+	before := git(t, repo.RepoDir, "rev-parse", "origin/master")
+	tagged := commitFile(t, seed, "file", "tagged\n", "tagged commit")
+	git(t, seed, "tag", "v1")
+	git(t, seed, "push", "-q", "origin", "master", "v1")
+
+	if err := repo.FetchTagsOnly(); err != nil {
+		t.Fatal(err)
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "v1"); sha != tagged {
+		t.Errorf("expected v1 at %s, got %s", tagged, sha)
+	}
+	if sha := git(t, repo.RepoDir, "rev-parse", "origin/master"); sha != before {
+		t.Errorf("origin/master moved to %s", sha)
+	}
+}
+
+func TestComputeSyncState(t *testing.T) {
+	remote, seed := newRemote(t)
+	repo := newRepo(t, remote, SetComputeSyncState())
+	if state := repo.SyncState; state == nil || *state != (SyncState{Clean: true}) {
+		t.Errorf("expected a clean, synced state, got %+v", state)
+	}
+
+	commitFile(t, repo.RepoDir, "local", "local\n", "local commit")
+	commitFile(t, seed, "upstream", "upstream\n", "upstream commit")
+	git(t, seed, "push", "-q")
+	git(t, repo.RepoDir, "fetch", "-q")
+	writeFile(t, repo.RepoDir, "README", "dirty\n")
+
+	// offline, so New doesn't pull the upstream commit in
+	again, err := New(remote, "master", repo.WorkDir, log.NewNopLogger(), SetOffline(), SetComputeSyncState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := again.SyncState; state == nil || *state != (SyncState{Ahead: 1, Behind: 1}) {
+		t.Errorf("expected ahead 1 and behind 1, got %+v", state)
+	}
+}
+
+func TestStash(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	writeFile(t, repo.RepoDir, "README", "local change\n")
+
+	if err := repo.Stash("work in progress"); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.IsClean() {
+		t.Error("expected a clean repo after stashing")
+	}
+	entries, err := repo.StashList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.Contains(entries[0].Message, "work in progress") {
+		t.Errorf("unexpected stashes %+v", entries)
+	}
+
+	if err := repo.StashPop(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(repo.RepoDir, "README"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "local change\n" {
+		t.Errorf("expected the change back, got %q", data)
+	}
+	if entries, _ := repo.StashList(); len(entries) != 0 {
+		t.Errorf("expected no stashes left, got %+v", entries)
+	}
+	if err := repo.Stash("again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Stash("nothing"); err != ErrNoLocalChanges {
+		t.Errorf("expected ErrNoLocalChanges, got %v", err)
+	}
+}
+
+func TestMergeDriver(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	commitFile(t, repo.RepoDir, ".gitattributes", "file merge=take-theirs\n", "use the merge driver")
+	diverge(t, repo.RepoDir, "file", "base\n", "ours\n", "theirs\n")
+
+	// the driver ignores the base, but SetMergeDriver requires all placeholders
+	if err := repo.Merge("other", SetMergeDriver("take-theirs", "cat %B > %A # %O")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(repo.RepoDir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "theirs\n" {
+		t.Errorf("expected the driver to take their version, got %q", data)
+	}
+	if err := repo.Merge("other", SetMergeDriver("bad", "cat %A")); err == nil {
+		t.Error("expected an error for a driver without all placeholders")
+	}
+}
+
+func TestCatFile(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	blob := git(t, dir, "rev-parse", "HEAD:README")
+	commit := git(t, dir, "rev-parse", "HEAD")
+
+	data, err := repo.CatFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello\n" {
+		t.Errorf("unexpected blob content %q", data)
+	}
+	data, err = repo.CatFile(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "tree ") || !strings.HasSuffix(string(data), "\ninitial commit\n") {
+		t.Errorf("unexpected commit content %q", data)
+	}
+	for sha, want := range map[string]string{blob: "blob", commit: "commit"} {
+		if typ, err := repo.CatFileType(sha); err != nil || typ != want {
+			t.Errorf("%s: expected type %s, got %s, %v", sha, want, typ, err)
+		}
+	}
+}
+
+func TestDeleteMergedBranches(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	for _, branch := range []string{"merged-one", "merged-two", "unmerged"} {
+		git(t, dir, "checkout", "-q", "-b", branch, "master")
+		commitFile(t, dir, branch, branch+"\n", branch)
+	}
+	git(t, dir, "checkout", "-q", "master")
+	git(t, dir, "merge", "-q", "--no-ff", "-m", "merge one", "merged-one")
+	git(t, dir, "merge", "-q", "--no-ff", "-m", "merge two", "merged-two")
+
+	deleted, err := repo.DeleteMergedBranches("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deleted)
+	if strings.Join(deleted, " ") != "merged-one merged-two" {
+		t.Errorf("unexpected deleted branches %v", deleted)
+	}
+	branches, err := repo.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(branches)
+	if strings.Join(branches, " ") != "master unmerged" {
+		t.Errorf("unexpected remaining branches %v", branches)
+	}
+}
+
+func TestIdentityWithoutConfig(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote, SetAuthor("Author", "author@example.com"), SetCommitter("Committer", "committer@example.com"))
+	dir := repo.RepoDir
+	base := git(t, dir, "rev-parse", "HEAD")
+	for _, branch := range []string{"other", "pick"} {
+		git(t, dir, "checkout", "-q", "-b", branch, base)
+		commitFile(t, dir, branch, branch+"\n", branch+" commit")
+	}
+	git(t, dir, "checkout", "-q", "master")
+	commitFile(t, dir, "master", "master\n", "master commit")
+	noIdentity(t, dir)
+
+	if err := repo.SquashMerge("other", "squashed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Replay(base, "pick"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateTag("v1", "release"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "README", "stashed\n")
+	if err := repo.Stash("stashed"); err != nil {
+		t.Fatal(err)
+	}
+	// the pick keeps its original author
+	if ident := git(t, dir, "log", "-1", "--format=%cn <%ce>", "HEAD"); ident != "Committer <committer@example.com>" {
+		t.Errorf("unexpected committer of the pick %s", ident)
+	}
+	if ident := git(t, dir, "log", "-1", "--format=%an <%ae> %cn <%ce>", "HEAD^"); ident != "Author <author@example.com> Committer <committer@example.com>" {
+		t.Errorf("unexpected identity of the squash %s", ident)
+	}
+	if tagger := git(t, dir, "for-each-ref", "--format=%(taggername) %(taggeremail)", "refs/tags/v1"); tagger != "Committer <committer@example.com>" {
+		t.Errorf("unexpected tagger %s", tagger)
+	}
+}
+
+func TestMessageCleanup(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	msg := "# generated\n# do not edit\n\nupdate README"
+
+	writeFile(t, dir, "README", "verbatim\n")
+	if err := repo.Add("README"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Commit(msg, SetMessageCleanup("verbatim")); err != nil {
+		t.Fatal(err)
+	}
+	if body := git(t, dir, "log", "-1", "--format=%B"); body != msg {
+		t.Errorf("unexpected message %q", body)
+	}
+	if _, err := repo.Commit(msg, SetMessageCleanup("none")); err == nil {
+		t.Error("expected an error for an invalid cleanup mode")
+	}
+}
+
+func TestAddHunks(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	lines := make([]string, 20)
+	for i := range lines {
+		lines[i] = "line " + strconv.Itoa(i)
+	}
+	commitFile(t, dir, "file", strings.Join(lines, "\n")+"\n", "add file")
+	// changes at both ends, far enough apart to be separate hunks
+	changed := append([]string{}, lines...)
+	changed[0] = "first changed"
+	changed[19] = "last changed"
+	writeFile(t, dir, "file", strings.Join(changed, "\n")+"\n")
+
+	if err := repo.AddHunks("file", []int{1}); err != nil {
+		t.Fatal(err)
+	}
+	staged := append([]string{}, lines...)
+	staged[19] = "last changed"
+	if index := git(t, dir, "show", ":file"); index != strings.Join(staged, "\n") {
+		t.Errorf("unexpected index content %q", index)
+	}
+	if err := repo.AddHunks("file", []int{1}); err == nil {
+		t.Error("expected an error for a hunk out of range")
+	}
+}
+
+func TestStateRef(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	first := git(t, dir, "rev-parse", "HEAD")
+	second := commitFile(t, dir, "file", "content\n", "second commit")
+
+	if _, err := repo.GetStateRef("processed"); errors.Cause(err) != ErrNoSuchStateRef {
+		t.Errorf("expected ErrNoSuchStateRef, got %v", err)
+	}
+	for _, sha := range []string{first, second} {
+		if err := repo.SetStateRef("processed", sha); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.GetStateRef("processed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != sha {
+			t.Errorf("expected state ref %s, got %s", sha, got)
+		}
+	}
+}
+
+func TestLargeObjects(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	large := strings.Repeat("x", 4096)
+	commit := commitFile(t, dir, "large.bin", large, "add large file")
+	blob := git(t, dir, "rev-parse", "HEAD:large.bin")
+
+	objects, err := repo.LargeObjects(4095)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 large object, got %v", objects)
+	}
+	object := objects[0]
+	if object.SHA != blob || object.Path != "large.bin" || object.Size != int64(len(large)) {
+		t.Errorf("unexpected large object %+v", object)
+	}
+	if len(object.Commits) != 1 || object.Commits[0] != commit {
+		t.Errorf("expected commits [%s], got %v", commit, object.Commits)
+	}
+	objects, err = repo.LargeObjects(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("expected no large objects at the threshold, got %v", objects)
+	}
+}
+
+func TestPushSetUpstream(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	if err := repo.CheckoutNew("feature"); err != nil {
+		t.Fatal(err)
+	}
+	head := commitFile(t, dir, "feature", "feature\n", "add feature")
+
+	if err := repo.Push(SetUpstream()); err != nil {
+		t.Fatal(err)
+	}
+	if ref := git(t, remote, "rev-parse", "refs/heads/feature"); ref != head {
+		t.Errorf("expected remote feature at %s, got %s", head, ref)
+	}
+	if upstream := git(t, dir, "rev-parse", "--abbrev-ref", "@{u}"); upstream != "origin/feature" {
+		t.Errorf("unexpected upstream %s", upstream)
+	}
+}
+
+func TestCheckoutRef(t *testing.T) {
+	remote, seed := newRemote(t)
+	tagged := git(t, seed, "rev-parse", "HEAD")
+	git(t, seed, "tag", "-a", "-m", "release", "v1")
+	git(t, seed, "checkout", "-q", "-b", "feature")
+	feature := commitFile(t, seed, "feature", "feature\n", "add feature")
+	git(t, seed, "push", "-q", "origin", "feature", "v1")
+
+	for _, test := range []struct {
+		ref      string
+		branch   string
+		expected string
+	}{
+		{ref: "feature", branch: "feature", expected: feature},
+		{ref: "v1", expected: tagged},
+		{ref: feature, expected: feature},
+	} {
+		repo := newRepo(t, remote, SetCheckoutRef(test.ref))
+		ref, detached, err := repo.CurrentRef()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.branch != "" && (detached || ref != test.branch) {
+			t.Errorf("%s: expected branch %s, got %s", test.ref, test.branch, ref)
+		}
+		if test.branch == "" && !detached {
+			t.Errorf("%s: expected a detached HEAD, got %s", test.ref, ref)
+		}
+		if head, _ := repo.CurrentCommit(); head != test.expected {
+			t.Errorf("%s: expected HEAD at %s, got %s", test.ref, test.expected, head)
+		}
+	}
+}
+
+func TestBlame(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	writeFile(t, dir, "file", "one\ntwo\nthree\nfour\n")
+	git(t, dir, "add", "file")
+	gitAt(t, dir, "2020-01-01T00:00:00Z", "commit", "-q", "-m", "add file")
+	first := git(t, dir, "rev-parse", "HEAD")
+	writeFile(t, dir, "file", "one\nTWO\nthree\nFOUR\n")
+	git(t, dir, "add", "file")
+	git(t, dir, "-c", "user.name=Other", "-c", "user.email=other@example.com", "commit", "-q", "-m", "change file")
+	second := git(t, dir, "rev-parse", "HEAD")
+
+	lines, err := repo.Blame("file", SetBlameRange(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		commit  string
+		author  string
+		content string
+	}{
+		{second, "Other", "TWO"},
+		{first, "Test User", "three"},
+		{second, "Other", "FOUR"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %+v", len(expected), lines)
+	}
+	for i, e := range expected {
+		line := lines[i]
+		if line.Commit != e.commit || line.AuthorName != e.author || line.Content != e.content || line.LineNo != i+2 {
+			t.Errorf("line %d: got %+v", i+2, line)
+		}
+	}
+	if !lines[1].Time.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected time %s", lines[1].Time)
+	}
+
+	lines, err = repo.Blame("file", SetBlameRev(first), SetBlameRange(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[1].Content != "two" || lines[1].Commit != first {
+		t.Errorf("unexpected blame at %s: %+v", first, lines)
+	}
+}
+
+func TestShallowBoundary(t *testing.T) {
+	remote, seed := newRemote(t)
+	boundary := commitFile(t, seed, "file", "second\n", "second commit")
+	commitFile(t, seed, "file", "third\n", "third commit")
+	git(t, seed, "push", "-q")
+
+	full := newRepo(t, remote)
+	commits, err := full.ShallowBoundary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 0 {
+		t.Errorf("expected no boundary for a full clone, got %v", commits)
+	}
+
+	shallow := newRepo(t, "file://"+remote, SetDepth(2))
+	commits, err = shallow.ShallowBoundary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0] != boundary {
+		t.Errorf("expected boundary [%s], got %v", boundary, commits)
+	}
+}
+
+func TestConcurrentAddCommitPush(t *testing.T) {
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote)
+	dir := repo.RepoDir
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "file" + strconv.Itoa(i)
+			// t.Fatal can't be used outside the test goroutine
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name+"\n"), 0644); err != nil {
+				errs <- err
+				return
+			}
+			// single commands don't need Lock
+			if err := repo.Add(name); err != nil {
+				errs <- err
+				return
+			}
+			repo.Lock()
+			defer repo.Unlock()
+			if err := ioutil.WriteFile(filepath.Join(dir, name+".more"), []byte(name+"\n"), 0644); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := repo.AddCommitPush("add " + name); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if count := git(t, remote, "rev-list", "--count", "master"); count != strconv.Itoa(workers+1) {
+		t.Errorf("expected %d commits on the remote, got %s", workers+1, count)
+	}
+	if files := git(t, remote, "ls-tree", "--name-only", "master"); len(strings.Fields(files)) != 2*workers+1 {
+		t.Errorf("unexpected files on the remote %s", files)
+	}
+}
+
+func TestCommitTemplate(t *testing.T) {
+	var calls [][]string
+	remote, _ := newRemote(t)
+	repo := newRepo(t, remote, recordArgs(&calls))
+	dir := repo.RepoDir
+	template := filepath.Join(t.TempDir(), "template")
+	if err := ioutil.WriteFile(template, []byte("# fill in the ticket\nTicket: none\nReviewed-by: nobody\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "file", "content\n")
+	if err := repo.Add("file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.Commit("add file", SetCommitTemplate(template)); err != nil {
+		t.Fatal(err)
+	}
+	call := findCall(calls, "commit")
+	if strings.Join(call[:2], " ") != "-c commit.template="+template {
+		t.Errorf("commit.template not set in %v", call)
+	}
+	if msg := git(t, dir, "log", "-1", "--format=%B"); msg != "add file\n\nTicket: none\nReviewed-by: nobody" {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	remote, _ := newRemote(t)
+	// the shim hangs on the git command in GOGIT_SLOW, and runs git for
+	// everything else
+	shim := filepath.Join(t.TempDir(), "git")
+	script := "#!/bin/sh\nfor arg; do\n\tif [ \"$arg\" = \"$GOGIT_SLOW\" ]; then exec sleep 30; fi\ndone\nexec git \"$@\"\n"
+	if err := ioutil.WriteFile(shim, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var repo *Repo
+	for _, test := range []struct {
+		cmd string
+		run func(ctx context.Context) error
+	}{
+		{"clone", func(ctx context.Context) (err error) {
+			_, err = NewCtx(ctx, remote, "master", t.TempDir(), log.NewNopLogger(), SetGitBinary(shim))
+			return err
+		}},
+		{"pull", func(ctx context.Context) error { return repo.PullCtx(ctx) }},
+		{"push", func(ctx context.Context) error { return repo.PushCtx(ctx) }},
+	} {
+		t.Setenv("GOGIT_SLOW", "")
+		repo = newRepo(t, remote, SetGitBinary(shim))
+		t.Setenv("GOGIT_SLOW", test.cmd)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		err := test.run(ctx)
+		if errors.Cause(err) != context.Canceled {
+			t.Errorf("%s: expected context.Canceled, got %v", test.cmd, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: took %s to return after cancelling", test.cmd, elapsed)
+		}
+		cancel()
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/jeroenvand/gogit
 
-go 1.12
+go 1.17
 
 require (
 	github.com/go-kit/kit v0.8.0